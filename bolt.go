@@ -0,0 +1,236 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sync"
+	"time"
+)
+
+// boltstore keeps the sessions in a bbolt database, for single binary
+// deployments.
+// The sessions bucket maps the session ID to the expire time (8 bytes, unix
+// nanoseconds, big endian) followed by the serialized session data.
+// The expiry bucket is the index of the expire time, its keys are the
+// expire time followed by the session ID, so the sweeper only iterates the
+// expired sessions.
+type boltstore struct {
+	db       *bolt.DB
+	sessions []byte
+	expiry   []byte
+	codec    Codec
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+const (
+	defaultBoltBucket = "sessions"
+	defaultBoltGCTime = 60
+)
+
+func init() {
+	Register("bolt", &boltstore{})
+}
+
+// options sample:
+//
+//	`{  "path": "/var/lib/app/sessions.db",
+//	    "bucket": "sessions",
+//	    "gcinterval": 60,
+//	    "codec": "gob"
+//	 }`
+//
+// the expiry index is in bucket bucket+"_expiry".
+// gcinterval is the interval of deleting the expired sessions in seconds,
+// default 60. codec is gob, json or msgpack, default gob.
+func (bs *boltstore) Open(options string) (Store, error) {
+	var config struct {
+		Path       string
+		Bucket     string
+		Gcinterval int
+		Codec      string
+	}
+
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, fmt.Errorf("bolt store: invalid options: %s", err.Error())
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("bolt store: path should not be empty")
+	}
+	if config.Bucket == "" {
+		config.Bucket = defaultBoltBucket
+	}
+	if config.Gcinterval <= 0 {
+		config.Gcinterval = defaultBoltGCTime
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	// do not wait forever if another process opened the database
+	db, err := bolt.Open(config.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	st := &boltstore{
+		db:       db,
+		sessions: []byte(config.Bucket),
+		expiry:   []byte(config.Bucket + "_expiry"),
+		codec:    codec,
+		done:     make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(st.sessions); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(st.expiry)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	st.wg.Add(1)
+	go st.gc(time.Duration(config.Gcinterval) * time.Second)
+
+	return st, nil
+}
+
+// expiryKey returns the key of session key in the expiry bucket
+func expiryKey(e []byte, key string) []byte {
+	return append(append(make([]byte, 0, len(e)+len(key)), e...), key...)
+}
+
+// for session interface Get
+func (bs *boltstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	var buf []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bs.sessions).Get([]byte(key))
+		if len(v) < 8 {
+			return nil
+		}
+		// expired but not swept yet
+		if int64(binary.BigEndian.Uint64(v[:8])) <= time.Now().UnixNano() {
+			return nil
+		}
+		// v is only valid in the transaction
+		buf = append([]byte(nil), v[8:]...)
+		return nil
+	})
+	if err != nil || buf == nil {
+		return nil, err
+	}
+
+	data, err := deserialize(buf)
+	if err != nil {
+		return nil, fmt.Errorf("bolt store: deserialize: %s", err.Error())
+	}
+	return data, nil
+}
+
+// for session interface SetStore
+func (bs *boltstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	e := data[expiresTS].(time.Time)
+	if !e.After(time.Now()) {
+		return bs.Delete(ctx, key)
+	}
+
+	buf, err := serialize(bs.codec, data)
+	if err != nil {
+		return err
+	}
+
+	v := make([]byte, 8, 8+len(buf))
+	binary.BigEndian.PutUint64(v, uint64(e.UnixNano()))
+	v = append(v, buf...)
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := bs.remove(tx, key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bs.sessions).Put([]byte(key), v); err != nil {
+			return err
+		}
+		return tx.Bucket(bs.expiry).Put(expiryKey(v[:8], key), nil)
+	})
+}
+
+// for session interface DelStore
+func (bs *boltstore) Delete(ctx context.Context, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return bs.remove(tx, key)
+	})
+}
+
+// remove session key and its expiry index in transaction tx
+func (bs *boltstore) remove(tx *bolt.Tx, key string) error {
+	b := tx.Bucket(bs.sessions)
+	v := b.Get([]byte(key))
+	if len(v) < 8 {
+		return nil
+	}
+	if err := tx.Bucket(bs.expiry).Delete(expiryKey(v[:8], key)); err != nil {
+		return err
+	}
+	return b.Delete([]byte(key))
+}
+
+// gc deletes the expired sessions every interval, until Close
+func (bs *boltstore) gc(interval time.Duration) {
+	defer bs.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bs.done:
+			return
+		case n := <-ticker.C:
+			if err := bs.sweep(n); err != nil {
+				log.Printf(errorFormat, err)
+			}
+		}
+	}
+}
+
+// sweep deletes the sessions expired before n
+func (bs *boltstore) sweep(n time.Time) error {
+	max := make([]byte, 8)
+	binary.BigEndian.PutUint64(max, uint64(n.UnixNano()))
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(bs.sessions)
+		c := tx.Bucket(bs.expiry).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], max) <= 0; k, _ = c.Next() {
+			if err := sessions.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close stops the sweeper, and closes the database
+func (bs *boltstore) Close() error {
+	var err error
+	bs.closeOnce.Do(func() {
+		close(bs.done)
+		bs.wg.Wait()
+		err = bs.db.Close()
+	})
+	return err
+}
@@ -0,0 +1,55 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_BoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	options := fmt.Sprintf(`{"path": %q}`, path)
+
+	st, err := Open("bolt", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := st.(*boltstore)
+
+	ctx := context.Background()
+	n := time.Now()
+	st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(time.Minute), "hello": "world"}, 60)
+	// refresh
+	st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(time.Hour), "hello": "world"}, 3600)
+	st.Set(ctx, "expiring", Sessiondata{expiresTS: n.Add(time.Minute)}, 60)
+
+	if err := bs.sweep(n.Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := st.Get(ctx, "expiring"); d != nil {
+		t.Error("expired session not swept")
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get(ctx, "alive"); err == nil {
+		t.Error("closed store still usable")
+	}
+
+	// reopen
+	st, err = Open("bolt", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.(*boltstore).Close()
+
+	if d, err := st.Get(ctx, "alive"); err != nil || d["hello"] != "world" {
+		t.Error("session not persisted", d, err)
+	}
+	st.Delete(ctx, "alive")
+	if d, _ := st.Get(ctx, "alive"); d != nil {
+		t.Error("session delete failed")
+	}
+}
@@ -0,0 +1,322 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+	"time"
+)
+
+// Codec serializes the session data for the stores.
+// The stored data starts with an envelope header recording the ID of the
+// codec, so the data written by any registered codec can be read after the
+// codec of a store is changed.
+type Codec interface {
+	// Name is the name of the codec in the options of the stores
+	Name() string
+	// ID is recorded in the envelope header, 1-63 are reserved for the
+	// codecs of this package
+	ID() byte
+	Marshal(data Sessiondata) ([]byte, error)
+	Unmarshal(src []byte) (Sessiondata, error)
+}
+
+const (
+	// the envelope header is envelopeMagic, envelopeVersion and the ID of
+	// the codec. A gob stream never starts with 0, so the data written
+	// before the envelope is read as gob.
+	envelopeMagic   = 0
+	envelopeVersion = 1
+	envelopeSize    = 3
+)
+
+var (
+	codecs   = make(map[string]Codec)
+	codecIDs = make(map[byte]Codec)
+
+	// defaultCodec is the codec of the stores without codec option
+	defaultCodec Codec = gobCodec{}
+)
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register([]interface{}{})
+
+	RegisterCodec(gobCodec{})
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(msgpackCodec{})
+}
+
+// RegisterCodec makes a codec available by its name in the options of the
+// stores. If RegisterCodec is called twice with the same name or ID, or if
+// codec is nil, it panics.
+func RegisterCodec(codec Codec) {
+	if codec == nil {
+		panic("session: RegisterCodec codec is nil")
+	}
+	if _, dup := codecs[codec.Name()]; dup {
+		panic("session: RegisterCodec called twice for codec " + codec.Name())
+	}
+	if _, dup := codecIDs[codec.ID()]; dup {
+		panic(fmt.Sprintf("session: RegisterCodec called twice for codec ID %d", codec.ID()))
+	}
+	codecs[codec.Name()] = codec
+	codecIDs[codec.ID()] = codec
+}
+
+// openCodec returns the codec registered as name, the default codec if
+// name is empty
+func openCodec(name string) (Codec, error) {
+	if name == "" {
+		return defaultCodec, nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("session: unknown codec %q (forgotten import?)", name)
+	}
+	return codec, nil
+}
+
+// serialize marshals data by codec, with the envelope header
+func serialize(codec Codec, data Sessiondata) ([]byte, error) {
+	buf, err := codec.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{envelopeMagic, envelopeVersion, codec.ID()}, buf...), nil
+}
+
+// deserialize unmarshals src by the codec recorded in its envelope header,
+// src without the header is gob
+func deserialize(src []byte) (Sessiondata, error) {
+	if len(src) == 0 || src[0] != envelopeMagic {
+		return gobCodec{}.Unmarshal(src)
+	}
+	if len(src) < envelopeSize {
+		return nil, fmt.Errorf("session: truncated envelope header")
+	}
+	if src[1] != envelopeVersion {
+		return nil, fmt.Errorf("session: unknown envelope version %d", src[1])
+	}
+	codec, ok := codecIDs[src[2]]
+	if !ok {
+		return nil, fmt.Errorf("session: unknown codec ID %d", src[2])
+	}
+	return codec.Unmarshal(src[envelopeSize:])
+}
+
+// gobCodec is the default codec, the custom types in the session must be
+// registered by gob.Register
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+func (gobCodec) ID() byte     { return 1 }
+
+func (gobCodec) Marshal(data Sessiondata) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(src []byte) (Sessiondata, error) {
+	dst := make(Sessiondata)
+	dec := gob.NewDecoder(bytes.NewBuffer(src))
+	if err := dec.Decode(&dst); err != nil {
+		return dst, err
+	}
+	return dst, nil
+}
+
+// jsonCodec writes the session as a JSON object, every value with a type
+// hint so it is read back as the same Go type:
+//
+//	{"hello": {"t": "string", "v": "world"}, "_expires": {"t": "time", "v": "2006-01-02T15:04:05Z"}}
+//
+// The keys must be strings, the values may be nil, bool, string, the
+// numbers, []byte, time.Time, []interface{} and map[string]interface{}.
+type jsonCodec struct{}
+
+// jsonValue is a value with its type hint
+type jsonValue struct {
+	T string          `json:"t"`
+	V json.RawMessage `json:"v,omitempty"`
+}
+
+// the numbers are hinted by their kind
+var jsonNumbers = map[string]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0), float64(0)} {
+		jsonNumbers[reflect.TypeOf(v).Kind().String()] = reflect.TypeOf(v)
+	}
+}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) ID() byte     { return 2 }
+
+func (jsonCodec) Marshal(data Sessiondata) ([]byte, error) {
+	obj := make(map[string]jsonValue, len(data))
+	for k, v := range data {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("json codec: key %v is not a string", k)
+		}
+		jv, err := toJSONValue(v)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = jv
+	}
+	return json.Marshal(obj)
+}
+
+func (jsonCodec) Unmarshal(src []byte) (Sessiondata, error) {
+	var obj map[string]jsonValue
+	if err := json.Unmarshal(src, &obj); err != nil {
+		return nil, err
+	}
+
+	dst := make(Sessiondata, len(obj))
+	for k, jv := range obj {
+		v, err := fromJSONValue(jv)
+		if err != nil {
+			return nil, err
+		}
+		dst[k] = v
+	}
+	return dst, nil
+}
+
+func toJSONValue(v interface{}) (jsonValue, error) {
+	var (
+		jv  jsonValue
+		val interface{} = v
+	)
+
+	switch v := v.(type) {
+	case nil:
+		return jsonValue{T: "null"}, nil
+	case bool:
+		jv.T = "bool"
+	case string:
+		jv.T = "string"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		jv.T = reflect.TypeOf(v).Kind().String()
+	case []byte:
+		jv.T = "bytes"
+	case time.Time:
+		jv.T = "time"
+	case []interface{}:
+		list := make([]jsonValue, len(v))
+		for i, e := range v {
+			ev, err := toJSONValue(e)
+			if err != nil {
+				return jv, err
+			}
+			list[i] = ev
+		}
+		jv.T, val = "list", list
+	case map[string]interface{}:
+		obj := make(map[string]jsonValue, len(v))
+		for k, e := range v {
+			ev, err := toJSONValue(e)
+			if err != nil {
+				return jv, err
+			}
+			obj[k] = ev
+		}
+		jv.T, val = "map", obj
+	default:
+		return jv, fmt.Errorf("json codec: unsupported type %T", v)
+	}
+
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return jv, err
+	}
+	jv.V = buf
+	return jv, nil
+}
+
+func fromJSONValue(jv jsonValue) (interface{}, error) {
+	var ptr interface{}
+
+	switch jv.T {
+	case "null":
+		return nil, nil
+	case "bool":
+		ptr = new(bool)
+	case "string":
+		ptr = new(string)
+	case "bytes":
+		ptr = new([]byte)
+	case "time":
+		ptr = new(time.Time)
+	case "list":
+		var list []jsonValue
+		if err := json.Unmarshal(jv.V, &list); err != nil {
+			return nil, err
+		}
+		dst := make([]interface{}, len(list))
+		for i, ev := range list {
+			e, err := fromJSONValue(ev)
+			if err != nil {
+				return nil, err
+			}
+			dst[i] = e
+		}
+		return dst, nil
+	case "map":
+		var obj map[string]jsonValue
+		if err := json.Unmarshal(jv.V, &obj); err != nil {
+			return nil, err
+		}
+		dst := make(map[string]interface{}, len(obj))
+		for k, ev := range obj {
+			e, err := fromJSONValue(ev)
+			if err != nil {
+				return nil, err
+			}
+			dst[k] = e
+		}
+		return dst, nil
+	default:
+		t, ok := jsonNumbers[jv.T]
+		if !ok {
+			return nil, fmt.Errorf("json codec: unknown type hint %q", jv.T)
+		}
+		ptr = reflect.New(t).Interface()
+	}
+
+	if err := json.Unmarshal(jv.V, ptr); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(ptr).Elem().Interface(), nil
+}
+
+// msgpackCodec writes the session as a msgpack map. The integers are read
+// back as the smallest type holding them, time.Time is the msgpack
+// timestamp extension.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) ID() byte     { return 3 }
+
+func (msgpackCodec) Marshal(data Sessiondata) ([]byte, error) {
+	return msgpack.Marshal(map[interface{}]interface{}(data))
+}
+
+func (msgpackCodec) Unmarshal(src []byte) (Sessiondata, error) {
+	var dst map[interface{}]interface{}
+	if err := msgpack.Unmarshal(src, &dst); err != nil {
+		return nil, err
+	}
+	return Sessiondata(dst), nil
+}
@@ -0,0 +1,113 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Codecs(t *testing.T) {
+	e := time.Now().Add(time.Minute).Round(0)
+	data := Sessiondata{
+		expiresTS:  e,
+		"name":     "gopher",
+		"uid":      int64(1) << 40,
+		"admin":    true,
+		flashesKey: []interface{}{"saved", "done"},
+	}
+
+	for _, name := range []string{"gob", "json", "msgpack"} {
+		codec, err := openCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := serialize(codec, data)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if buf[0] != envelopeMagic || buf[1] != envelopeVersion || buf[2] != codec.ID() {
+			t.Error(name, "invalid envelope header", buf[:3])
+		}
+
+		sd, err := deserialize(buf)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !sd[expiresTS].(time.Time).Equal(e) {
+			t.Error(name, "expire time changed", sd[expiresTS])
+		}
+		if sd["name"] != "gopher" || sd["admin"] != true ||
+			!reflect.DeepEqual(sd[flashesKey], []interface{}{"saved", "done"}) {
+			t.Error(name, "session data changed", sd)
+		}
+		if fmt.Sprint(sd["uid"]) != fmt.Sprint(int64(1)<<40) {
+			t.Error(name, "uid changed", sd["uid"])
+		}
+	}
+
+	// json keeps the exact types by the type hints
+	sd, _ := deserialize(mustSerialize(t, jsonCodec{}, Sessiondata{"n": int8(3), "f": 1.5, "b": []byte("x")}))
+	if sd["n"] != int8(3) || sd["f"] != 1.5 || !bytes.Equal(sd["b"].([]byte), []byte("x")) {
+		t.Error("json type hints lost", sd)
+	}
+	if _, err := serialize(jsonCodec{}, Sessiondata{1: "x"}); err == nil {
+		t.Error("json accepted a key not string")
+	}
+
+	// the data written before the envelope is gob
+	legacy, _ := gobCodec{}.Marshal(data)
+	if sd, err := deserialize(legacy); err != nil || sd["name"] != "gopher" {
+		t.Error("legacy gob data not read", sd, err)
+	}
+
+	if _, err := Open("memcache", `{"codec": "xml"}`); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+func mustSerialize(t *testing.T, codec Codec, data Sessiondata) []byte {
+	buf, err := serialize(codec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func Test_CodecMigration(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	data := Sessiondata{expiresTS: time.Now().Add(time.Minute), "hello": "world"}
+
+	st, err := Open("file", fmt.Sprintf(`{"dir": %q}`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set(ctx, "abc", data, 60)
+	st.(*filestore).Close()
+
+	// switch the store to json, the sessions written by gob are still read
+	st, err = Open("file", fmt.Sprintf(`{"dir": %q, "codec": "json"}`, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.(*filestore).Close()
+
+	sd, err := st.Get(ctx, "abc")
+	if err != nil || sd["hello"] != "world" {
+		t.Fatal("gob session not read after codec change", sd, err)
+	}
+	st.Set(ctx, "abc", sd, 60)
+
+	buf, err := os.ReadFile(filepath.Join(dir, filePrefix+"abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[2] != (jsonCodec{}).ID() || !bytes.Contains(buf, []byte(`"hello":{"t":"string","v":"world"}`)) {
+		t.Errorf("session not rewritten by json: %q", buf)
+	}
+}
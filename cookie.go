@@ -0,0 +1,136 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// cookiestore keeps the whole session data in the cookie, encrypted and
+// authenticated by AES-GCM, nothing is stored on the server.
+type cookiestore struct {
+	aead    cipher.AEAD
+	maxsize int
+	codec   Codec
+}
+
+const (
+	// browsers limit a cookie to 4096 bytes, including its name and
+	// attributes, so leave some room for them
+	defaultCookieMaxSize = 4000
+)
+
+// ErrCookieTooLarge is returned by Save when the encoded session data
+// exceeds the cookie size limit of cookie store
+var ErrCookieTooLarge = errors.New("session: session data exceeds the cookie size limit")
+
+func init() {
+	Register("cookie", cookiestore{})
+}
+
+// options sample:
+//
+//	`{  "key": "hex encoded AES key, 16, 24 or 32 bytes",
+//	    "maxsize": 4000,
+//	    "codec": "gob"
+//	 }`
+//
+// codec is gob, json or msgpack, default gob.
+func (cs cookiestore) Open(options string) (Store, error) {
+	var config struct {
+		Key     string
+		Maxsize int
+		Codec   string
+	}
+
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, fmt.Errorf("cookie store: invalid options: %s", err.Error())
+	}
+
+	key, err := hex.DecodeString(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("cookie store: invalid key: %s", err.Error())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cookie store: invalid key: %s", err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Maxsize <= 0 {
+		config.Maxsize = defaultCookieMaxSize
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return cookiestore{aead: aead, maxsize: config.Maxsize, codec: codec}, nil
+}
+
+// Encode serializes data, and encrypts it with a random nonce
+func (cs cookiestore) Encode(data Sessiondata) (string, error) {
+	buf, err := serialize(cs.codec, data)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, cs.aead.NonceSize(), cs.aead.NonceSize()+len(buf)+cs.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(cs.aead.Seal(nonce, nonce, buf, nil))
+	if len(value) > cs.maxsize {
+		return "", ErrCookieTooLarge
+	}
+
+	return value, nil
+}
+
+// Decode decrypts value, and deserializes the session data
+func (cs cookiestore) Decode(value string) (Sessiondata, error) {
+	if len(value) > cs.maxsize {
+		return nil, ErrCookieTooLarge
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := cs.aead.NonceSize()
+	if len(buf) < ns {
+		return nil, errors.New("session: cookie value too short")
+	}
+	buf, err = cs.aead.Open(nil, buf[:ns], buf[ns:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserialize(buf)
+}
+
+// the data is in cookie, nothing to get from server
+func (cs cookiestore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	return nil, nil
+}
+
+// the data is in cookie, nothing to set on server
+func (cs cookiestore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	return nil
+}
+
+// the data is in cookie, nothing to delete from server
+func (cs cookiestore) Delete(ctx context.Context, key string) error {
+	return nil
+}
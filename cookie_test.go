@@ -0,0 +1,66 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const cookieOptions = `{"key": "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"}`
+
+func Test_CookieSession(t *testing.T) {
+	m, err := NewManager("sid", "cookie", cookieOptions, "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := FromContext(r.Context())
+		s.Init()
+		switch r.URL.Path {
+		case "/set":
+			s.SetKey("hello", "world")
+		case "/show":
+			if s.Get("hello") != "world" {
+				t.Error("Session write failed")
+			}
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/set", nil)
+	h.ServeHTTP(res, req)
+	if strings.Contains(res.Header().Get("Set-Cookie"), "world") {
+		t.Fatal("session data not encrypted")
+	}
+
+	res2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/show", nil)
+	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	h.ServeHTTP(res2, req2)
+
+	// tampered cookie
+	c := res.Result().Cookies()[0]
+	c.Value = c.Value[:len(c.Value)-2] + "AA"
+	req3, _ := http.NewRequest("GET", "/", nil)
+	req3.AddCookie(c)
+	if ok, _ := m.NewSession(req3).Init(); ok {
+		t.Error("tampered cookie accepted")
+	}
+}
+
+func Test_CookieTooLarge(t *testing.T) {
+	m, err := NewManager("sid", "cookie", cookieOptions, "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := m.NewSession(req)
+	s.SetKey("big", strings.Repeat("x", 5000))
+	if err := s.Save(httptest.NewRecorder()); err != ErrCookieTooLarge {
+		t.Error("expect ErrCookieTooLarge, got", err)
+	}
+}
@@ -0,0 +1,281 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filestore keeps every session in its own file in a directory.
+// A session file is written to a temporary file and renamed, so readers
+// never see a partial file, and writers of the same session are serialized
+// by file locks, which work across processes sharing the directory.
+// The modification time of a session file is set to the expire time of the
+// session, so the sweeper finds the expired sessions without reading them.
+type filestore struct {
+	dir   string
+	codec Codec
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	filePrefix = "sess_"
+	// writers are serialized by lockStripes lock files, chosen by the hash
+	// of the session ID
+	lockStripes       = 64
+	defaultFileGCTime = 60
+)
+
+var errInvalidKey = errors.New("session: invalid session key")
+
+func init() {
+	Register("file", &filestore{})
+}
+
+// options sample:
+//
+//	`{  "dir": "/var/lib/app/sessions",
+//	    "gcinterval": 60,
+//	    "codec": "gob"
+//	 }`
+//
+// gcinterval is the interval of sweeping the expired sessions in seconds,
+// default 60. codec is gob, json or msgpack, default gob.
+func (fs *filestore) Open(options string) (Store, error) {
+	var config struct {
+		Dir        string
+		Gcinterval int
+		Codec      string
+	}
+
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, fmt.Errorf("file store: invalid options: %s", err.Error())
+	}
+	if config.Dir == "" {
+		return nil, fmt.Errorf("file store: dir should not be empty")
+	}
+	if config.Gcinterval <= 0 {
+		config.Gcinterval = defaultFileGCTime
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	st := &filestore{
+		dir:   config.Dir,
+		codec: codec,
+		done:  make(chan struct{}),
+	}
+	go st.gc(time.Duration(config.Gcinterval) * time.Second)
+
+	return st, nil
+}
+
+// path returns the file of session key
+func (fs *filestore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		return "", errInvalidKey
+	}
+	return filepath.Join(fs.dir, filePrefix+key), nil
+}
+
+// lock locks the lock file of session key, and returns the unlock function
+func (fs *filestore) lock(key string) (func(), error) {
+	name := filepath.Join(fs.dir, fmt.Sprintf(".lock-%02d", hashKey(key)%lockStripes))
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// for session interface Get
+func (fs *filestore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := deserialize(buf)
+	if err != nil {
+		return nil, fmt.Errorf("file store: deserialize %s: %s", path, err.Error())
+	}
+	// expired but not swept yet
+	if exp, ok := data[expiresTS].(time.Time); !ok || !exp.After(time.Now()) {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+// for session interface SetStore
+func (fs *filestore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	e := data[expiresTS].(time.Time)
+	if !e.After(time.Now()) {
+		return fs.Delete(ctx, key)
+	}
+
+	buf, err := serialize(fs.codec, data)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := fs.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.CreateTemp(fs.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), e, e); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// for session interface DelStore
+func (fs *filestore) Delete(ctx context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := fs.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// gc removes the expired sessions every interval, until Close
+func (fs *filestore) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fs.done:
+			return
+		case n := <-ticker.C:
+			if err := fs.sweep(n); err != nil {
+				log.Printf(errorFormat, err)
+			}
+		}
+	}
+}
+
+// sweep removes the sessions expired before n
+func (fs *filestore) sweep(n time.Time) error {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), filePrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(n) {
+			continue
+		}
+		key := strings.TrimPrefix(e.Name(), filePrefix)
+		if err := fs.sweepOne(key, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepOne removes session key if it expired before n, it is checked with
+// the lock held, since the session may be refreshed concurrently
+func (fs *filestore) sweepOne(key string, n time.Time) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil
+	}
+
+	unlock, err := fs.lock(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().After(n) {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close stops the sweeper of the store
+func (fs *filestore) Close() error {
+	fs.closeOnce.Do(func() {
+		close(fs.done)
+	})
+	return nil
+}
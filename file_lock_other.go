@@ -0,0 +1,21 @@
+//go:build !unix
+
+package session
+
+import (
+	"os"
+	"sync"
+)
+
+// without flock, the writers are serialized in this process only
+var fileLock sync.Mutex
+
+func lockFile(f *os.File) error {
+	fileLock.Lock()
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	fileLock.Unlock()
+	return nil
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_FileStore(t *testing.T) {
+	st, err := Open("file", fmt.Sprintf(`{"dir": %q}`, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := st.(*filestore)
+	defer fs.Close()
+
+	ctx := context.Background()
+	n := time.Now()
+	st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(time.Hour), "hello": "world"}, 3600)
+	st.Set(ctx, "expiring", Sessiondata{expiresTS: n.Add(time.Minute)}, 60)
+
+	if d, err := st.Get(ctx, "alive"); err != nil || d["hello"] != "world" {
+		t.Error("session write failed", d, err)
+	}
+
+	fs.sweep(n.Add(30 * time.Minute))
+	if d, _ := st.Get(ctx, "expiring"); d != nil {
+		t.Error("expired session not swept")
+	}
+	if d, _ := st.Get(ctx, "alive"); d == nil {
+		t.Error("live session swept")
+	}
+
+	st.Delete(ctx, "alive")
+	if d, _ := st.Get(ctx, "alive"); d != nil {
+		t.Error("session delete failed")
+	}
+
+	if _, err := st.Get(ctx, "../passwd"); err != errInvalidKey {
+		t.Error("invalid key accepted")
+	}
+}
+
+func Test_FileConcurrent(t *testing.T) {
+	st, err := Open("file", fmt.Sprintf(`{"dir": %q}`, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.(*filestore).Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := Sessiondata{expiresTS: time.Now().Add(time.Hour), "i": i}
+			if err := st.Set(ctx, "same", data, 3600); err != nil {
+				t.Error(err)
+			}
+			if d, err := st.Get(ctx, "same"); err != nil || d == nil {
+				t.Error("partial session read", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+// IDGenerator generates the session IDs.
+// The IDs are sent in cookies and used as the keys of the stores, so they
+// must be URL-safe and should not contain '.', '/' or '\' (see file store).
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// IDGeneratorFunc is an ordinary function used as IDGenerator
+type IDGeneratorFunc func() (string, error)
+
+func (f IDGeneratorFunc) NewID() (string, error) {
+	return f()
+}
+
+type randomIDGenerator struct {
+	size int
+}
+
+func (g randomIDGenerator) NewID() (string, error) {
+	buf := make([]byte, g.size)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+const (
+	// bytes of the default random IDs, 128 bits
+	defaultIDSize = 16
+	// a generated ID found in the store is generated again, up to
+	// maxIDAttempts times
+	maxIDAttempts = 3
+)
+
+// RandomIDGenerator is the default generator, the IDs are 128 bits from
+// crypto/rand, base64 URL encoded
+var RandomIDGenerator IDGenerator = randomIDGenerator{defaultIDSize}
+
+// NewRandomIDGenerator returns a generator of size bytes random IDs,
+// size is at least 16.
+func NewRandomIDGenerator(size int) IDGenerator {
+	if size < defaultIDSize {
+		size = defaultIDSize
+	}
+	return randomIDGenerator{size}
+}
+
+// PrefixIDGenerator returns a generator of the IDs of g prefixed with
+// prefix, eg. the shard of the session.
+func PrefixIDGenerator(prefix string, g IDGenerator) IDGenerator {
+	return IDGeneratorFunc(func() (string, error) {
+		id, err := g.NewID()
+		if err != nil {
+			return "", err
+		}
+		return prefix + id, nil
+	})
+}
+
+// SetIDGenerator sets the session ID generator of the default manager
+func SetIDGenerator(g IDGenerator) {
+	defaultManager.SetIDGenerator(g)
+}
+
+// SetIDGenerator sets the session ID generator of the manager, the default
+// is RandomIDGenerator.
+func (m *Manager) SetIDGenerator(g IDGenerator) {
+	m.idGenerator = g
+}
+
+// newID returns a new session ID not found in the store. The check is best
+// effort, the ID is used if the store fails, the store errors are returned
+// when the session is set anyway. The errors of the generator are returned,
+// no other generator is used since the IDs may be routed by their format.
+func (m *Manager) newID(ctx context.Context) (string, error) {
+	for i := 0; i < maxIDAttempts; i++ {
+		id, err := m.idGenerator.NewID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := m.store.(ClientStore); ok || m.store == nil {
+			return id, nil
+		}
+		if sd, err := m.store.Get(ctx, id); err != nil || sd == nil {
+			return id, nil
+		}
+	}
+	return "", errors.New("session: too many session ID collisions")
+}
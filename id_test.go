@@ -0,0 +1,107 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func Test_RandomID(t *testing.T) {
+	urlSafe := regexp.MustCompile(`^[A-Za-z0-9_-]{22}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := RandomIDGenerator.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !urlSafe.MatchString(id) {
+			t.Fatal("invalid random ID", id)
+		}
+		if seen[id] {
+			t.Fatal("duplicated random ID", id)
+		}
+		seen[id] = true
+	}
+
+	if id, _ := NewRandomIDGenerator(8).NewID(); len(id) != 22 {
+		t.Error("random ID shorter than 128 bits", id)
+	}
+	if id, _ := NewRandomIDGenerator(32).NewID(); len(id) != 43 {
+		t.Error("random ID of 32 bytes", id)
+	}
+}
+
+func Test_IDGenerator(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store.Set(context.Background(), "s1:used", Sessiondata{expiresTS: time.Now().Add(time.Minute)}, 60)
+
+	// the first ID is in the store already
+	ids := []string{"used", "fresh"}
+	m.SetIDGenerator(PrefixIDGenerator("s1:", IDGeneratorFunc(func() (string, error) {
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	})))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := m.NewSession(req)
+	s.Create(0, nil)
+	if key := s.(*session).key; key != "s1:fresh" {
+		t.Error("collision not regenerated, key", key)
+	}
+
+	m.SetIDGenerator(RandomIDGenerator)
+	s2 := m.NewSession(req)
+	s2.SetKey("hello", "world")
+	key := s2.(*session).key
+	m.SetIDGenerator(IDGeneratorFunc(func() (string, error) { return "s1:used", nil }))
+	if err := s2.Regenerate(); err == nil || s2.(*session).key != key {
+		t.Error("endless collisions not returned", s2.(*session).key, err)
+	}
+}
+
+func Test_IDGeneratorFailed(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetIDGenerator(IDGeneratorFunc(func() (string, error) {
+		return "", errors.New("generator down")
+	}))
+
+	// no session, the IDs are not made by another generator
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := m.NewSession(req)
+	s.SetKey("a", 1)
+	if s.(*session).key != "" || s.Get("a") != nil {
+		t.Error("session created without the generator", s.(*session).key)
+	}
+	if err := s.Save(httptest.NewRecorder()); err == nil || err.Error() != "generator down" {
+		t.Error("generator error not returned by Save", err)
+	}
+
+	// the random generator fails
+	m.SetIDGenerator(RandomIDGenerator)
+	reader := rand.Reader
+	rand.Reader = iotest.ErrReader(errors.New("no entropy"))
+	defer func() { rand.Reader = reader }()
+
+	s = m.NewSession(req)
+	s.SetKey("a", 1)
+	s.AddFlash("x")
+	if err := s.Regenerate(); err == nil {
+		t.Error("Regenerate without ID succeeded")
+	}
+	if err := s.(*session).flush(httptest.NewRecorder()); err == nil {
+		t.Error("session without ID flushed")
+	}
+}
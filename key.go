@@ -0,0 +1,99 @@
+package session
+
+import (
+	"reflect"
+	"time"
+)
+
+// Key is a session key of values of type T, so handlers get and set the
+// value without type assertions:
+//
+//	var userID = session.Key[int64]("uid")
+//
+//	userID.Set(s, 42)
+//	uid, ok := userID.Get(s)
+type Key[T any] string
+
+// Get returns the value of the key in session s. The numbers are converted
+// to T if it is a number type and the value fits, since the codecs do not
+// keep the number types the same. ok is false if the key is missing, or
+// the value is not a T.
+func (k Key[T]) Get(s Session) (T, bool) {
+	return convert[T](s.Get(string(k)))
+}
+
+// Set sets the value of the key in session s
+func (k Key[T]) Set(s Session, v T) {
+	s.SetKey(string(k), v)
+}
+
+// Delete deletes the key from session s
+func (k Key[T]) Delete(s Session) {
+	s.DelKey(string(k))
+}
+
+// GetString returns the string value of key in session s
+func GetString(s Session, key string) (string, bool) {
+	return Key[string](key).Get(s)
+}
+
+// GetInt64 returns the value of key in session s as int64, the value may
+// be any integer type, or a float without fraction.
+func GetInt64(s Session, key string) (int64, bool) {
+	return Key[int64](key).Get(s)
+}
+
+// GetTime returns the time value of key in session s, the value may be a
+// time.Time or a RFC 3339 string.
+func GetTime(s Session, key string) (time.Time, bool) {
+	if str, ok := s.Get(key).(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, str)
+		return t, err == nil
+	}
+	return Key[time.Time](key).Get(s)
+}
+
+// convert returns v as T, the numbers are converted if the value is kept
+func convert[T any](v interface{}) (T, bool) {
+	var zero T
+	if t, ok := v.(T); ok {
+		return t, true
+	}
+	if v == nil {
+		return zero, false
+	}
+
+	// T is an interface type if rt is nil
+	rt := reflect.TypeOf(zero)
+	rv := reflect.ValueOf(v)
+	if rt == nil || !isNumber(rt.Kind()) || !isNumber(rv.Kind()) {
+		return zero, false
+	}
+	// the sign is lost between signed and unsigned numbers
+	if isUint(rt.Kind()) && ((isInt(rv.Kind()) && rv.Int() < 0) || (isFloat(rv.Kind()) && rv.Float() < 0)) ||
+		isInt(rt.Kind()) && isUint(rv.Kind()) && rv.Uint() > 1<<63-1 {
+		return zero, false
+	}
+	cv := rv.Convert(rt)
+	if !cv.Convert(rv.Type()).Equal(rv) {
+		// overflow or fraction
+		return zero, false
+	}
+	return cv.Interface().(T), true
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isNumber(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || isFloat(k)
+}
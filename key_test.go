@@ -0,0 +1,70 @@
+package session
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_Keys(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := m.NewSession(req)
+
+	uid := Key[int64]("uid")
+	uid.Set(s, 1<<40)
+	if v, ok := uid.Get(s); !ok || v != 1<<40 {
+		t.Error("typed key get failed", v, ok)
+	}
+	if v, ok := Key[string]("uid").Get(s); ok {
+		t.Error("int64 value got as string", v)
+	}
+	if _, ok := Key[int8]("uid").Get(s); ok {
+		t.Error("overflowed value got as int8")
+	}
+	uid.Delete(s)
+	if _, ok := uid.Get(s); ok {
+		t.Error("deleted key got")
+	}
+
+	// the number types written by the codecs
+	e := time.Now().Round(0)
+	for _, codec := range []Codec{gobCodec{}, jsonCodec{}, msgpackCodec{}} {
+		sd, err := deserialize(mustSerialize(t, codec, Sessiondata{
+			expiresTS: time.Now().Add(time.Minute), "n": 42, "name": "gopher", "at": e}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.(*session).data = sd
+
+		if n, ok := GetInt64(s, "n"); !ok || n != 42 {
+			t.Error(codec.Name(), "GetInt64 failed", n, ok)
+		}
+		if n, ok := Key[uint8]("n").Get(s); !ok || n != 42 {
+			t.Error(codec.Name(), "uint8 key failed", n, ok)
+		}
+		if name, ok := GetString(s, "name"); !ok || name != "gopher" {
+			t.Error(codec.Name(), "GetString failed", name, ok)
+		}
+		if at, ok := GetTime(s, "at"); !ok || !at.Equal(e) {
+			t.Error(codec.Name(), "GetTime failed", at, ok)
+		}
+	}
+
+	for v, ok := range map[interface{}]bool{1.0: true, 1.5: false, int8(-1): true, uint64(1 << 63): false} {
+		if _, got := convert[int64](v); got != ok {
+			t.Errorf("convert %T %v to int64: %v", v, v, got)
+		}
+	}
+	if _, ok := convert[uint](-1); ok {
+		t.Error("negative converted to uint")
+	}
+
+	s.SetKey("rfc", e.Format(time.RFC3339Nano))
+	if at, ok := GetTime(s, "rfc"); !ok || !at.Equal(e) {
+		t.Error("GetTime of RFC 3339 string failed", at, ok)
+	}
+}
@@ -0,0 +1,254 @@
+package session
+
+import (
+	"fmt"
+	"github.com/go-martini/martini"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Manager owns a session store, the secret to sign cookies, and the cookie
+// settings of the sessions it creates.
+// Managers do not share anything, so an application may run several of
+// them in one process, eg. an admin site and a public site with different
+// cookies.
+type Manager struct {
+	store Store
+	name  string
+	// secretKeys[0] signs cookies, all of them verify cookies
+	secretKeys [][]byte
+	// signer signs cookies, verifiers verify cookies
+	signer     Signer
+	verifiers  []Signer
+	maxAge     int
+	maxDurtion time.Duration
+	cookie     CookieOptions
+	// the old ID of a regenerated session is kept for regenerateGrace
+	regenerateGrace time.Duration
+	idGenerator     IDGenerator
+}
+
+// the manager used by the package level functions
+var defaultManager = newManager()
+
+func newManager() *Manager {
+	m := &Manager{
+		name:        "sid",
+		cookie:      CookieOptions{Path: "/"},
+		idGenerator: RandomIDGenerator,
+	}
+	m.SetMaxAge(365 * 86400)
+	m.SetSigner(HMACSHA256, HMACSHA1)
+	return m
+}
+
+// NewManager create a Manager whose sessions are stored in store storetype
+// opened with dsn, and sent to browsers in cookie name signed with secret.
+// If name is empty, "sid" is used.
+func NewManager(name, storetype, dsn, secret string) (*Manager, error) {
+	m := newManager()
+	if err := m.open(name, storetype, dsn, secret); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manager) open(name, storetype, dsn, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("secret Should NOT be empty.")
+	}
+
+	store, err := Open(storetype, dsn)
+	if err != nil {
+		return err
+	}
+
+	m.store = store
+	if name != "" {
+		m.name = name
+	}
+	// secret is the current key, the keys set by SetSecrets before are kept
+	// as previous keys
+	keys := [][]byte{[]byte(secret)}
+	for _, k := range m.secretKeys {
+		if string(k) != secret {
+			keys = append(keys, k)
+		}
+	}
+	m.secretKeys = keys
+
+	return nil
+}
+
+// Sessions is a Middleware that maps a session.Session service of this
+// manager into the Martini handler chain.
+func (m *Manager) Sessions() martini.Handler {
+	return func(res http.ResponseWriter, r *http.Request, c martini.Context,
+		l *log.Logger) {
+		// Map to the Session interface
+		s := m.newSession(r)
+		c.MapTo(s, (*Session)(nil))
+
+		rw := res.(martini.ResponseWriter)
+		rw.Before(func(martini.ResponseWriter) {
+			check(s.flush(res), l)
+		})
+	}
+}
+
+// NewSession returns the session of request r
+func (m *Manager) NewSession(r *http.Request) Session {
+	return m.newSession(r)
+}
+
+func (m *Manager) newSession(r *http.Request) *session {
+	s := &session{m: m, ctx: r.Context()}
+	s.cookie, _ = r.Cookie(m.name)
+
+	return s
+}
+
+// Store returns the session store of the manager
+func (m *Manager) Store() Store {
+	return m.store
+}
+
+// Close releases the resources of the store, eg. stops the garbage
+// collector of memory store. It should be called when the app shuts down.
+func (m *Manager) Close() error {
+	if c, ok := m.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Name returns the cookie name of the manager
+func (m *Manager) Name() string {
+	return m.name
+}
+
+func (m *Manager) MaxAge() int {
+	return m.maxAge
+}
+
+func (m *Manager) SetMaxAge(age int) {
+	m.maxAge = age
+	m.maxDurtion = time.Duration(age) * time.Second
+}
+
+func (m *Manager) HttpOnly() bool {
+	return !m.cookie.NoHttpOnly
+}
+
+func (m *Manager) SetHttpOnly(http bool) {
+	m.cookie.NoHttpOnly = !http
+}
+
+func (m *Manager) Secure() bool {
+	return m.cookie.Secure
+}
+
+func (m *Manager) SetSecure(s bool) {
+	m.cookie.Secure = s
+}
+
+// CookieOptions are the attributes of the session cookie, the zero value
+// is a HttpOnly cookie of path "/" expiring with the session.
+// Browsers reject the cookies with SameSite None or Partitioned which are
+// not Secure.
+type CookieOptions struct {
+	Domain string
+	// default "/"
+	Path     string
+	SameSite http.SameSite
+	// MaxAge zero sends Max-Age and Expires of the session expire time,
+	// positive sends MaxAge seconds instead, negative sends neither, so the
+	// cookie is deleted when the browser closes.
+	MaxAge int
+	// the cookie is HttpOnly unless NoHttpOnly is set, so scripts can
+	// not read it by default
+	NoHttpOnly bool
+	Secure     bool
+	// Partitioned cookie of CHIPS, stored per top-level site
+	Partitioned bool
+}
+
+func (m *Manager) CookieOptions() CookieOptions {
+	return m.cookie
+}
+
+// SetCookieOptions sets the attributes of the session cookie, they are used
+// by Save and Clear, so the cleared cookie matches the saved one.
+// o replaces all attributes, including those set by SetHttpOnly and
+// SetSecure.
+func (m *Manager) SetCookieOptions(o CookieOptions) {
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	m.cookie = o
+}
+
+// newCookie returns the session cookie of value, the session expires at
+// expires
+func (m *Manager) newCookie(value string, expires time.Time) *http.Cookie {
+	o := m.cookie
+	c := &http.Cookie{
+		Name:     m.name,
+		Value:    value,
+		Domain:   o.Domain,
+		Path:     o.Path,
+		SameSite: o.SameSite,
+		HttpOnly: !o.NoHttpOnly,
+		Secure:   o.Secure,
+	}
+
+	switch {
+	case o.MaxAge > 0:
+		c.MaxAge = o.MaxAge
+		c.Expires = time.Now().Add(time.Duration(o.MaxAge) * time.Second).UTC()
+	case o.MaxAge == 0:
+		c.MaxAge = int((time.Until(expires) + time.Second - 1) / time.Second)
+		if c.MaxAge <= 0 {
+			// Max-Age=0, the session expired
+			c.MaxAge = -1
+		}
+		c.Expires = expires.UTC()
+	}
+	return c
+}
+
+// clearCookie returns the cookie deleting the session cookie, with the
+// same attributes
+func (m *Manager) clearCookie(value string) *http.Cookie {
+	c := m.newCookie(value, time.Time{})
+	c.MaxAge = -1
+	c.Expires = time.Unix(0, 0).UTC()
+	return c
+}
+
+// setCookie adds the Set-Cookie header of c to res, like http.SetCookie.
+// The Partitioned attribute is appended by hand, http.Cookie has no field
+// for it before Go 1.23.
+func (m *Manager) setCookie(res http.ResponseWriter, c *http.Cookie) {
+	v := c.String()
+	if v == "" {
+		return
+	}
+	if m.cookie.Partitioned {
+		v += "; Partitioned"
+	}
+	res.Header().Add("Set-Cookie", v)
+}
+
+func (m *Manager) RegenerateGrace() time.Duration {
+	return m.regenerateGrace
+}
+
+// SetRegenerateGrace sets how long the old ID of a regenerated session is
+// kept, for the concurrent requests with the old cookie. Zero deletes the
+// old ID at once, which is the default.
+func (m *Manager) SetRegenerateGrace(d time.Duration) {
+	m.regenerateGrace = d
+}
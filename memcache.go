@@ -0,0 +1,135 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"time"
+)
+
+// mcstore keeps every session in a memcached item, prefix+ID, which
+// expires with the session by the native expiration of memcached.
+type mcstore struct {
+	client *memcache.Client
+	prefix string
+	codec  Codec
+}
+
+const (
+	defaultMemcacheServer = "localhost:11211"
+	// memcached treats expirations longer than 30 days as unix timestamps
+	maxRelativeExpiration = 30 * 86400
+)
+
+func init() {
+	Register("memcache", mcstore{})
+}
+
+// options sample:
+//
+//	`{  "servers": ["127.0.0.1:11211", "127.0.0.1:11212"],
+//	    "prefix": "session:",
+//	    "timeout": 500,
+//	    "maxidle": 10,
+//	    "codec": "gob"
+//	 }`
+//
+// timeout is the socket read/write timeout in milliseconds.
+// codec is gob, json or msgpack, default gob.
+func (ms mcstore) Open(options string) (Store, error) {
+	var config struct {
+		Servers []string
+		Prefix  string
+		Timeout int
+		Maxidle int
+		Codec   string
+	}
+
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &config); err != nil {
+			return nil, fmt.Errorf("memcache store: invalid options: %s", err.Error())
+		}
+	}
+	if len(config.Servers) == 0 {
+		config.Servers = []string{defaultMemcacheServer}
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultPrefix
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	client := memcache.New(config.Servers...)
+	if config.Timeout > 0 {
+		client.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	client.MaxIdleConns = config.Maxidle
+
+	return mcstore{client: client, prefix: config.Prefix, codec: codec}, nil
+}
+
+// for session interface Get
+func (ms mcstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	item, err := ms.client.Get(ms.prefix + key)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := deserialize(item.Value)
+	if err != nil {
+		return nil, fmt.Errorf("memcache GET failed: deserialize: %s", err.Error())
+	}
+	return data, nil
+}
+
+// for session interface SetStore
+// The item expires after timeout seconds, memcached removes it by itself.
+func (ms mcstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// already expired
+	if timeout <= 0 {
+		return ms.Delete(ctx, key)
+	}
+
+	buf, err := serialize(ms.codec, data)
+	if err != nil {
+		return err
+	}
+
+	expiration := int32(timeout)
+	if timeout > maxRelativeExpiration {
+		expiration = int32(time.Now().Unix()) + int32(timeout)
+	}
+
+	return ms.client.Set(&memcache.Item{
+		Key:        ms.prefix + key,
+		Value:      buf,
+		Expiration: expiration,
+	})
+}
+
+// for session interface DelStore
+func (ms mcstore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := ms.client.Delete(ms.prefix + key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
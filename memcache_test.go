@@ -0,0 +1,144 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached speaks enough of the memcached text protocol for the
+// memcache store: gets, set and delete, with expiration.
+type fakeMemcached struct {
+	ln    net.Listener
+	lock  sync.Mutex
+	items map[string]fakeItem
+}
+
+type fakeItem struct {
+	flags   string
+	value   []byte
+	expires time.Time
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &fakeMemcached{ln: ln, items: make(map[string]fakeItem)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return fm
+}
+
+func (fm *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		fm.lock.Lock()
+		switch f[0] {
+		case "gets", "get":
+			for _, key := range f[1:] {
+				it, ok := fm.items[key]
+				if ok && !it.expires.IsZero() && !it.expires.After(time.Now()) {
+					delete(fm.items, key)
+					ok = false
+				}
+				if ok {
+					fmt.Fprintf(rw, "VALUE %s %s %d 1\r\n%s\r\n", key, it.flags, len(it.value), it.value)
+				}
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(f[4])
+			buf := make([]byte, n+2)
+			io.ReadFull(rw, buf)
+			it := fakeItem{flags: f[2], value: buf[:n]}
+			if exp, _ := strconv.ParseInt(f[3], 10, 64); exp > maxRelativeExpiration {
+				it.expires = time.Unix(exp, 0)
+			} else if exp > 0 {
+				it.expires = time.Now().Add(time.Duration(exp) * time.Second)
+			}
+			fm.items[f[1]] = it
+			fmt.Fprintf(rw, "STORED\r\n")
+		case "delete":
+			if _, ok := fm.items[f[1]]; ok {
+				delete(fm.items, f[1])
+				fmt.Fprintf(rw, "DELETED\r\n")
+			} else {
+				fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			}
+		default:
+			fmt.Fprintf(rw, "ERROR\r\n")
+		}
+		fm.lock.Unlock()
+		rw.Flush()
+	}
+}
+
+func Test_MemcacheStore(t *testing.T) {
+	fm := newFakeMemcached(t)
+
+	st, err := Open("memcache", fmt.Sprintf(`{"servers": [%q]}`, fm.ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	n := time.Now()
+	if err := st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(365 * 24 * time.Hour), "hello": "world"}, 365*86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Set(ctx, "expiring", Sessiondata{expiresTS: n.Add(time.Second)}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := st.Get(ctx, "alive"); err != nil || d["hello"] != "world" {
+		t.Error("session write failed", d, err)
+	}
+	fm.lock.Lock()
+	if exp := fm.items[defaultPrefix+"alive"].expires; exp.Before(n.Add(364 * 24 * time.Hour)) {
+		t.Error("long expiration not sent as unix timestamp", exp)
+	}
+	fm.lock.Unlock()
+
+	time.Sleep(1100 * time.Millisecond)
+	if d, err := st.Get(ctx, "expiring"); err != nil || d != nil {
+		t.Error("session not expired by memcached", d, err)
+	}
+
+	if err := st.Delete(ctx, "alive"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := st.Get(ctx, "alive"); d != nil {
+		t.Error("session delete failed")
+	}
+	if err := st.Delete(ctx, "alive"); err != nil {
+		t.Error("delete missing session failed", err)
+	}
+}
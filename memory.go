@@ -1,77 +1,429 @@
 package session
 
 import (
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
+// memstore keeps the sessions in memory.
+// Like other stores, every request gets its own copy of the session data,
+// and the data is committed to the store by Set, so concurrent requests of
+// the same session never share a map.
+// The sessions are spread over shards by the hash of the session ID, each
+// shard has its own lock. The "memory" store has only one shard, the
+// "memory-sharded" store has defaultShards shards for high concurrency.
+// The expired sessions are removed by a single goroutine, which sweeps
+// the min-heaps of the expire time every gcInterval, until Close is called.
+// The store may be bounded by the count and/or the approximate bytes of the
+// sessions, the least recently used sessions are evicted when it is full.
+// If a snapshot file is given, the live sessions are written to it
+// periodically and on Close, and reloaded on Open.
 type memstore struct {
-	store   map[string]Sessiondata
-	lock    sync.RWMutex
+	shards []*memshard
+	// shards of the store opened by the registered store
+	nshards int
+
+	snapshot         string
+	snapshotInterval time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type memshard struct {
+	store  map[string]*memitem
+	expiry expiryHeap
+	// most recently used first
+	lru  *list.List
+	lock sync.RWMutex
+
+	// approximate bytes of the sessions in the shard
 	memused uint64
+	evicted uint64
+	// the caps of the shard, zero means no limit
+	maxsessions int
+	maxbytes    uint64
+}
+
+type memitem struct {
+	key     string
+	data    Sessiondata
+	expires time.Time
+	size    uint64
+	// index in the expiry heap
+	index int
+	// element in the lru list
+	elem *list.Element
+}
+
+// MemoryStats is the usage of a memory store
+type MemoryStats struct {
+	Sessions int
+	// approximate bytes of the sessions
+	Bytes uint64
+	// sessions evicted since the store opened
+	Evicted uint64
+}
+
+// expiryHeap is a min-heap of memitem ordered by expire time
+type expiryHeap []*memitem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
 }
 
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*memitem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+const (
+	gcInterval              = time.Second
+	defaultShards           = 32
+	defaultSnapshotInterval = 60
+)
+
 func init() {
-	Register("memory", memstore{})
+	Register("memory", &memstore{nshards: 1})
+	Register("memory-sharded", &memstore{nshards: defaultShards})
+}
+
+// options sample:
+//
+//	`{  "shards": 32,
+//	    "maxsessions": 100000,
+//	    "maxbytes": 104857600,
+//	    "snapshot": "/var/lib/app/sessions.snapshot",
+//	    "snapshotinterval": 60
+//	 }`
+//
+// maxsessions and maxbytes are the caps of the whole store, zero means no
+// limit. Every shard gets an equal part of them, and evicts by its own
+// part, so a sharded store may evict before the whole store is full. A
+// store capped below its shards has as many shards as the cap.
+// maxbytes is approximate, a shard keeps its most recent session even if
+// it is larger than the part of the shard.
+// snapshotinterval is in seconds, default 60.
+func (ms *memstore) Open(options string) (Store, error) {
+	var config struct {
+		Shards           int
+		Maxsessions      int
+		Maxbytes         uint64
+		Snapshot         string
+		Snapshotinterval int
+	}
+	config.Shards = ms.nshards
+
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &config); err != nil {
+			return nil, fmt.Errorf("memory store: invalid options: %s", err.Error())
+		}
+	}
+	if config.Shards <= 0 {
+		config.Shards = 1
+	}
+	// every shard has a part of the caps of at least 1, zero is no limit
+	if config.Maxsessions > 0 && config.Maxsessions < config.Shards {
+		config.Shards = config.Maxsessions
+	}
+	if config.Maxbytes > 0 && config.Maxbytes < uint64(config.Shards) {
+		config.Shards = int(config.Maxbytes)
+	}
+
+	if config.Snapshotinterval <= 0 {
+		config.Snapshotinterval = defaultSnapshotInterval
+	}
+
+	st := &memstore{
+		shards:           make([]*memshard, config.Shards),
+		nshards:          config.Shards,
+		snapshot:         config.Snapshot,
+		snapshotInterval: time.Duration(config.Snapshotinterval) * time.Second,
+		done:             make(chan struct{}),
+	}
+	// the parts of the shards sum up to the caps
+	n := config.Shards
+	for i := range st.shards {
+		sh := &memshard{
+			store:       make(map[string]*memitem),
+			lru:         list.New(),
+			maxsessions: config.Maxsessions / n,
+			maxbytes:    config.Maxbytes / uint64(n),
+		}
+		if i < config.Maxsessions%n {
+			sh.maxsessions++
+		}
+		if uint64(i) < config.Maxbytes%uint64(n) {
+			sh.maxbytes++
+		}
+		st.shards[i] = sh
+	}
+	if st.snapshot != "" {
+		if err := st.load(st.snapshot); err != nil {
+			return nil, err
+		}
+	}
+	go st.gc(gcInterval)
+
+	return st, nil
 }
 
-func (ms memstore) Open(options string) (Store, error) {
-	return memstore{store: make(map[string]Sessiondata)}, nil
+// shard returns the shard of session key
+func (ms *memstore) shard(key string) *memshard {
+	if len(ms.shards) == 1 {
+		return ms.shards[0]
+	}
+	return ms.shards[hashKey(key)%uint32(len(ms.shards))]
 }
 
-// for session interface Get
-func (ms memstore) Get(key string) Sessiondata {
-	var (
-		n, e time.Time
-	)
-	ms.lock.RLock()
-	if v, ok := ms.store[key]; ok {
-		ms.lock.RUnlock()
-		n = time.Now()
-		e = v[expiresTS].(time.Time)
-		// timeout
-		if n.After(e) {
-			ms.lock.Lock()
-			delete(ms.store, key)
-			ms.lock.Unlock()
-			return nil
+// hashKey returns the FNV-1a hash of session key, used to spread the
+// sessions over shards or lock stripes
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// gc removes the expired sessions every interval, and writes the snapshot
+// every snapshotInterval if needed, until Close
+func (ms *memstore) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var snapshot <-chan time.Time
+	if ms.snapshot != "" {
+		t := time.NewTicker(ms.snapshotInterval)
+		defer t.Stop()
+		snapshot = t.C
+	}
+
+	for {
+		select {
+		case <-ms.done:
+			return
+		case n := <-ticker.C:
+			ms.sweep(n)
+		case <-snapshot:
+			if err := ms.save(ms.snapshot); err != nil {
+				log.Printf(errorFormat, err)
+			}
 		}
-		return v
 	}
-	ms.lock.RUnlock()
-	return nil
+}
+
+// sweep removes the sessions expired before n
+func (ms *memstore) sweep(n time.Time) {
+	for _, sh := range ms.shards {
+		sh.lock.Lock()
+		for len(sh.expiry) > 0 && !sh.expiry[0].expires.After(n) {
+			sh.remove(sh.expiry[0])
+		}
+		sh.lock.Unlock()
+	}
+}
+
+// Close stops the garbage collector of the store, and writes the snapshot
+// if needed
+func (ms *memstore) Close() error {
+	var err error
+	ms.closeOnce.Do(func() {
+		close(ms.done)
+		if ms.snapshot != "" {
+			err = ms.save(ms.snapshot)
+		}
+	})
+	return err
+}
+
+// Stats returns the usage of the store
+func (ms *memstore) Stats() MemoryStats {
+	var stats MemoryStats
+	for _, sh := range ms.shards {
+		sh.lock.RLock()
+		stats.Sessions += len(sh.store)
+		stats.Bytes += sh.memused
+		stats.Evicted += sh.evicted
+		sh.lock.RUnlock()
+	}
+	return stats
+}
+
+// MemoryUsage returns the usage of s, which must be a memory store
+// returned by Open.
+func MemoryUsage(s Store) (MemoryStats, error) {
+	ms, ok := s.(*memstore)
+	if !ok {
+		return MemoryStats{}, fmt.Errorf("session: MemoryUsage: %T is not a memory store", s)
+	}
+	return ms.Stats(), nil
+}
+
+// for session interface Get
+// The expired sessions not swept yet are not returned.
+func (ms *memstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	sh := ms.shard(key)
+	if sh.bounded() {
+		// the lru list is updated
+		sh.lock.Lock()
+		defer sh.lock.Unlock()
+	} else {
+		sh.lock.RLock()
+		defer sh.lock.RUnlock()
+	}
+
+	item, ok := sh.store[key]
+	if !ok || !item.expires.After(time.Now()) {
+		return nil, nil
+	}
+	if sh.bounded() {
+		sh.lru.MoveToFront(item.elem)
+	}
+	return copyData(item.data), nil
 }
 
 // for session interface SetStore
-func (ms memstore) Set(key string, data Sessiondata, timeout int) error {
-	n := time.Now()
+func (ms *memstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
 	e := data[expiresTS].(time.Time)
-	if e.After(n) {
-		/*
-		 *	delete it from map when timeout
-		 */
-		tmr := time.AfterFunc(e.Sub(n), func() {
-			ms.lock.Lock()
-			delete(ms.store, key)
-			ms.lock.Unlock()
-		})
-		data["_tmr"] = tmr
-
-		ms.lock.Lock()
-		ms.store[key] = data
-		ms.lock.Unlock()
+	data = copyData(data)
+
+	sh := ms.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	item, ok := sh.store[key]
+	if !e.After(time.Now()) {
+		if ok {
+			sh.remove(item)
+		}
+		return nil
+	}
+
+	size := sizeOf(key, data)
+	if ok {
+		sh.memused += size - item.size
+		item.data = data
+		item.expires = e
+		item.size = size
+		heap.Fix(&sh.expiry, item.index)
+		sh.lru.MoveToFront(item.elem)
+	} else {
+		item = &memitem{key: key, data: data, expires: e, size: size}
+		sh.store[key] = item
+		heap.Push(&sh.expiry, item)
+		item.elem = sh.lru.PushFront(item)
+		sh.memused += size
 	}
 
+	sh.evict()
 	return nil
 }
 
 // for session interface DelStore
-func (ms memstore) Delete(key string) {
-	ms.lock.Lock()
-	delete(ms.store, key)
-	ms.lock.Unlock()
+func (ms *memstore) Delete(ctx context.Context, key string) error {
+	sh := ms.shard(key)
+	sh.lock.Lock()
+	if item, ok := sh.store[key]; ok {
+		sh.remove(item)
+	}
+	sh.lock.Unlock()
+	return nil
+}
+
+// remove item from the shard, the lock must be held
+func (sh *memshard) remove(item *memitem) {
+	heap.Remove(&sh.expiry, item.index)
+	sh.lru.Remove(item.elem)
+	delete(sh.store, item.key)
+	sh.memused -= item.size
+}
+
+func (sh *memshard) bounded() bool {
+	return sh.maxsessions > 0 || sh.maxbytes > 0
 }
 
-func (ms memstore) Memory() bool {
-	return true
+// evict the least recently used sessions until the shard is not over its
+// caps, the lock must be held. The most recently used one is kept anyway.
+func (sh *memshard) evict() {
+	for sh.lru.Len() > 1 {
+		if (sh.maxsessions <= 0 || len(sh.store) <= sh.maxsessions) &&
+			(sh.maxbytes <= 0 || sh.memused <= sh.maxbytes) {
+			return
+		}
+		sh.remove(sh.lru.Back().Value.(*memitem))
+		sh.evicted++
+	}
+}
+
+// sizeOf returns the approximate bytes of a session
+func sizeOf(key string, data Sessiondata) uint64 {
+	// the item, the map and the list element
+	size := uint64(len(key)) + 128
+	for k, v := range data {
+		size += sizeOfValue(k) + sizeOfValue(v)
+	}
+	return size
+}
+
+func sizeOfValue(v interface{}) uint64 {
+	// the interface
+	const word = 16
+	switch v := v.(type) {
+	case string:
+		return word + uint64(len(v))
+	case []byte:
+		return word + 24 + uint64(len(v))
+	case time.Time:
+		return word + 24
+	case []interface{}:
+		size := uint64(word + 24)
+		for _, e := range v {
+			size += sizeOfValue(e)
+		}
+		return size
+	case map[string]interface{}:
+		size := uint64(word + 48)
+		for k, e := range v {
+			size += word + uint64(len(k)) + sizeOfValue(e)
+		}
+		return size
+	default:
+		return word + 8
+	}
+}
+
+// copyData returns a copy of data, the flashes are copied too since they are
+// appended by the session. Other values are shared, they should be immutable.
+func copyData(data Sessiondata) Sessiondata {
+	dst := make(Sessiondata, len(data))
+	for k, v := range data {
+		if flashes, ok := v.([]interface{}); ok {
+			v = append([]interface{}(nil), flashes...)
+		}
+		dst[k] = v
+	}
+	return dst
 }
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+type contextKey struct{}
+
+// sessionKey is the key of the session in request context
+var sessionKey = contextKey{}
+
+// Middleware is a standard net/http middleware of the default manager,
+// it can be used with goji, chi, or plain net/http.
+func Middleware(next http.Handler) http.Handler {
+	return defaultManager.Middleware(next)
+}
+
+// Middleware stores the session of every request in the request context,
+// handlers get it by FromContext(r.Context()).
+// The dirty session data is set back to store, and the set-cookie header is
+// sent, just before the first byte of the response is written.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		s := m.newSession(r)
+		r = r.WithContext(context.WithValue(r.Context(), sessionKey, s))
+		s.ctx = r.Context()
+
+		rw := &responseWriter{ResponseWriter: res, s: s}
+		next.ServeHTTP(rw, r)
+		// the handler wrote nothing
+		rw.flush()
+	})
+}
+
+// FromContext returns the session stored in ctx by Middleware,
+// or nil if there is none.
+func FromContext(ctx context.Context) Session {
+	s, ok := ctx.Value(sessionKey).(*session)
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// responseWriter flushes the session before the response is written
+type responseWriter struct {
+	http.ResponseWriter
+	s       *session
+	flushed bool
+}
+
+func (rw *responseWriter) flush() {
+	if rw.flushed {
+		return
+	}
+	rw.flushed = true
+	if err := rw.s.flush(rw.ResponseWriter); err != nil {
+		log.Printf(errorFormat, err)
+	}
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.flush()
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.flush()
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (rw *responseWriter) Flush() {
+	rw.flush()
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the ResponseWriter doesn't support the Hijacker interface")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the original ResponseWriter, used by http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
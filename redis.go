@@ -1,53 +1,156 @@
 package session
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"log"
+	"os"
 	"time"
 )
 
 type redisstore struct {
-	pool    *redis.Pool
-	memused uint64
+	client redisClient
+	// every session is stored in key prefix+ID
+	prefix string
+	codec  Codec
+}
+
+// redisClient runs a command on the redis server holding key, which is a
+// single server, the master found by sentinels, or a node of the cluster.
+type redisClient interface {
+	Do(key string, cmd string, args ...interface{}) (interface{}, error)
+	Close() error
+}
+
+// poolClient is the client of a single server, or of the master found by
+// sentinels
+type poolClient struct {
+	pool *redis.Pool
+}
+
+func (pc poolClient) Do(key string, cmd string, args ...interface{}) (interface{}, error) {
+	conn := pc.pool.Get()
+	defer conn.Close()
+
+	return conn.Do(cmd, args...)
+}
+
+func (pc poolClient) Close() error {
+	return pc.pool.Close()
 }
 
 const (
 	defaultAddr     = "localhost:6379"
 	defaultNetwork  = "tcp"
 	defaultPoolSize = 10
+	defaultPrefix   = "session:"
+
+	// LegacyRedisHash is the hash used by the old versions to store all
+	// sessions
+	LegacyRedisHash = "sessions"
 )
 
 func init() {
 	Register("redis", redisstore{})
-	gob.Register(time.Time{})
-	gob.Register([]interface{}{})
+}
+
+type redisConfig struct {
+	Addr     string
+	Db       int
+	Network  string
+	Username string
+	Password string
+	Pools    int
+	Prefix   string
+	Codec    string
+
+	// pool settings, Get waits for a free connection if wait is true and
+	// there are maxactive connections
+	Maxactive int
+	Wait      bool
+
+	// timeouts in milliseconds
+	Connecttimeout int
+	Readtimeout    int
+	Writetimeout   int
+
+	TLS           bool
+	Tlscafile     string
+	Tlscertfile   string
+	Tlskeyfile    string
+	Tlsskipverify bool
+
+	// sentinel mode
+	Sentinels  []string
+	Mastername string
+
+	// cluster mode, addrs are the seed nodes, default addr
+	Cluster bool
+	Addrs   []string
+
+	// connect on the first command instead of Open, the errors of the
+	// server are returned by the commands then
+	Lazy bool
+
+	// timeouts and TLS of the connections
+	dialOptions []redis.DialOption
 }
 
 // options sample:
-//   `{  "addr": "127.0.0.1:6389",
-//       "network":"tcp",
-//       "db": 0,
-//       "password": "",
-//       "pools": 5
-//    }`
-func createPool(options string) *redis.Pool {
-	var config struct {
-		Addr     string
-		Db       int
-		Network  string
-		Password string
-		Pools    int
-	}
-
-	err := json.Unmarshal([]byte(options), &config)
-	if err != nil {
-		//println("unmarshal failed:", err.Error())
-		config.Addr = defaultAddr
-		config.Network = defaultNetwork
-		config.Pools = defaultPoolSize
+//
+//	`{  "addr": "127.0.0.1:6389",
+//	    "network":"tcp",
+//	    "db": 0,
+//	    "username": "",
+//	    "password": "",
+//	    "pools": 5,
+//	    "maxactive": 100,
+//	    "wait": true,
+//	    "connecttimeout": 1000,
+//	    "readtimeout": 500,
+//	    "writetimeout": 500,
+//	    "prefix": "session:",
+//	    "codec": "gob",
+//	    "lazy": false
+//	 }`
+//
+// username is the ACL user of redis 6, the timeouts are in milliseconds.
+// codec is gob, json or msgpack, default gob.
+// Open fails if the server is not reachable, unless lazy is true.
+//
+// TLS, the CA file and the client certificate are optional:
+//
+//	`{  "addr": "redis.example.com:6380",
+//	    "tls": true,
+//	    "tlscafile": "/etc/redis/ca.pem",
+//	    "tlscertfile": "/etc/redis/client.pem",
+//	    "tlskeyfile": "/etc/redis/client.key",
+//	    "tlsskipverify": false
+//	 }`
+//
+// sentinel mode, the master is found by the sentinels, and found again
+// after failover:
+//
+//	`{  "sentinels": ["127.0.0.1:26379", "127.0.0.1:26380"],
+//	    "mastername": "mymaster"
+//	 }`
+//
+// cluster mode, the session keys are routed to the nodes by their slots:
+//
+//	`{  "cluster": true,
+//	    "addrs": ["127.0.0.1:7000", "127.0.0.1:7001"]
+//	 }`
+func parseRedisOptions(options string) (redisConfig, error) {
+	var config redisConfig
+
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &config); err != nil {
+			return config, fmt.Errorf("redis store: invalid options: %s", err.Error())
+		}
 	}
 
 	if config.Pools <= 0 {
@@ -57,106 +160,290 @@ func createPool(options string) *redis.Pool {
 		config.Addr = defaultAddr
 	}
 	if config.Network == "" {
-		config.Network = "tcp"
+		config.Network = defaultNetwork
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultPrefix
+	}
+	if len(config.Addrs) == 0 {
+		config.Addrs = []string{config.Addr}
+	}
+	if config.Cluster && config.Db != 0 {
+		return config, fmt.Errorf("redis store: db %d is not supported by cluster", config.Db)
 	}
 
-	pool := &redis.Pool{
-		MaxIdle:     config.Pools,
-		IdleTimeout: 600 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial(config.Network, config.Addr)
-			if err != nil {
-				panic(err)
-				return nil, err
-			}
-			if config.Password != "" {
-				if _, err := c.Do("AUTH", config.Password); err != nil {
-					c.Close()
-					panic(err)
-					return nil, err
-				}
-			}
+	if config.Connecttimeout > 0 {
+		config.dialOptions = append(config.dialOptions,
+			redis.DialConnectTimeout(time.Duration(config.Connecttimeout)*time.Millisecond))
+	}
+	if config.Readtimeout > 0 {
+		config.dialOptions = append(config.dialOptions,
+			redis.DialReadTimeout(time.Duration(config.Readtimeout)*time.Millisecond))
+	}
+	if config.Writetimeout > 0 {
+		config.dialOptions = append(config.dialOptions,
+			redis.DialWriteTimeout(time.Duration(config.Writetimeout)*time.Millisecond))
+	}
+	if config.TLS {
+		tlsConfig, err := redisTLSConfig(config)
+		if err != nil {
+			return config, err
+		}
+		config.dialOptions = append(config.dialOptions,
+			redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+
+	return config, nil
+}
+
+// redisTLSConfig loads the CA and the client certificate of the options
+func redisTLSConfig(config redisConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Tlsskipverify}
 
-			return c, nil
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+	if config.Tlscafile != "" {
+		ca, err := os.ReadFile(config.Tlscafile)
+		if err != nil {
+			return nil, fmt.Errorf("redis store: read tlscafile failed: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("redis store: no certificate in tlscafile %s", config.Tlscafile)
+		}
+	}
+	if config.Tlscertfile != "" || config.Tlskeyfile != "" {
+		cert, err := tls.LoadX509KeyPair(config.Tlscertfile, config.Tlskeyfile)
+		if err != nil {
+			return nil, fmt.Errorf("redis store: load client certificate failed: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// createPool creates the connection pool, and checks the server is
+// reachable unless lazy is set
+func createPool(config redisConfig) (*redis.Pool, error) {
+	var pool *redis.Pool
+
+	if len(config.Sentinels) > 0 {
+		pool = newPool(config, func() (redis.Conn, error) {
+			return dialMaster(config)
+		}, testMaster)
+	} else {
+		pool = newPool(config, func() (redis.Conn, error) {
+			return dialNode(config, config.Addr)
+		}, testPing)
+	}
+
+	if config.Lazy {
+		return pool, nil
 	}
 
 	conn := pool.Get()
-	if _, err := conn.Do("PING"); err != nil {
-		panic(err.Error())
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("redis store: connect failed: %s", err.Error())
 	}
-	defer conn.Close()
 
-	return pool
+	return pool, nil
+}
+
+func newPool(config redisConfig, dial func() (redis.Conn, error),
+	test func(c redis.Conn, t time.Time) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:      config.Pools,
+		MaxActive:    config.Maxactive,
+		Wait:         config.Wait,
+		IdleTimeout:  600 * time.Second,
+		Dial:         dial,
+		TestOnBorrow: test,
+	}
+}
+
+func testPing(c redis.Conn, t time.Time) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// dialNode dials the redis server at addr, authenticates, and selects the db
+func dialNode(config redisConfig, addr string) (redis.Conn, error) {
+	c, err := redis.Dial(config.Network, addr, config.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Username != "" {
+		_, err = c.Do("AUTH", config.Username, config.Password)
+	} else if config.Password != "" {
+		_, err = c.Do("AUTH", config.Password)
+	}
+	if err == nil && config.Db != 0 {
+		_, err = c.Do("SELECT", config.Db)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
 }
 
 // Open redis connection
 func (rs redisstore) Open(options string) (Store, error) {
-	return redisstore{pool: createPool(options)}, nil
+	config, err := parseRedisOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	var client redisClient
+	if config.Cluster {
+		cc, err := newClusterClient(config)
+		if err != nil {
+			return nil, err
+		}
+		client = cc
+	} else {
+		pool, err := createPool(config)
+		if err != nil {
+			return nil, err
+		}
+		client = poolClient{pool: pool}
+	}
+
+	return redisstore{client: client, prefix: config.Prefix, codec: codec}, nil
 }
 
 // for session interface Get
-func (rs redisstore) Get(key string) Sessiondata {
-	val, ok := rs.pool.Get().Do("HGET", "sessions", key)
-	if ok != nil || val == nil {
-		return nil
+func (rs redisstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	val, err := redis.Bytes(rs.client.Do(rs.prefix+key, "GET", rs.prefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
 	}
-	data, err := deserialize(val.([]byte))
 	if err != nil {
-		fmt.Printf("redis GET failed: deserialize: %s\n", err.Error())
+		return nil, err
 	}
-	exp := data[expiresTS].(time.Time)
-	n := time.Now()
-	if n.After(exp) {
-		rs.pool.Get().Do("HDEL", "sessions", key)
-		return nil
+	data, err := deserialize(val)
+	if err != nil {
+		return nil, fmt.Errorf("redis GET failed: deserialize: %s", err.Error())
 	}
 
-	return data
+	return data, nil
 }
 
 // for session interface SetStore
-func (rs redisstore) Set(key string, data Sessiondata, timeout int) error {
-	buf, err := serialize(data)
-	if err != nil {
-		println(err.Error())
+// The session key expires after timeout seconds, redis removes it by itself.
+func (rs redisstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	_, err = rs.pool.Get().Do("HSET", "sessions", key, buf)
+	// already expired
+	if timeout <= 0 {
+		_, err := rs.client.Do(rs.prefix+key, "DEL", rs.prefix+key)
+		return err
+	}
+
+	buf, err := serialize(rs.codec, data)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = rs.client.Do(rs.prefix+key, "SET", rs.prefix+key, buf, "EX", timeout)
+	return err
 }
 
 // for session interface DelStore
-func (rs redisstore) Delete(key string) {
-	rs.pool.Get().Do("HDEL", "sessions", key)
+func (rs redisstore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := rs.client.Do(rs.prefix+key, "DEL", rs.prefix+key)
+	return err
 }
 
-func (rs redisstore) Memory() bool {
-	return false
+// Close closes the connections to redis
+func (rs redisstore) Close() error {
+	return rs.client.Close()
 }
 
-func serialize(data Sessiondata) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(data); err != nil {
-		return nil, err
+// MigrateRedisHash moves the sessions stored by the old versions in hash,
+// usually LegacyRedisHash, to their own keys with expiry, the expired
+// sessions are dropped. s must be a redis store returned by Open.
+// The sessions failed to decode, eg. of custom types not registered by
+// gob.Register, are logged and left in hash, so they are moved by another
+// run after the fix. It returns the number of sessions moved and left.
+func MigrateRedisHash(ctx context.Context, s Store, hash string) (moved, left int, err error) {
+	rs, ok := s.(redisstore)
+	if !ok {
+		return 0, 0, fmt.Errorf("session: MigrateRedisHash: %T is not a redis store", s)
 	}
-	return buf.Bytes(), nil
+
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, left, err
+		}
+
+		values, err := redis.Values(rs.client.Do(hash, "HSCAN", hash, cursor))
+		if err != nil {
+			return moved, left, err
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return moved, left, err
+		}
+		fields, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return moved, left, err
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, val := fields[i], fields[i+1]
+			data, err := deserialize([]byte(val))
+			if err != nil {
+				log.Printf(errorFormat, fmt.Errorf("session %q left in %s: %v", key, hash, err))
+				left++
+				continue
+			}
+			n, err := rs.migrate(hash, key, []byte(val), data)
+			if err != nil {
+				return moved, left, err
+			}
+			moved += n
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return moved, left, nil
 }
 
-func deserialize(src []byte) (Sessiondata, error) {
-	dst := make(Sessiondata)
-	dec := gob.NewDecoder(bytes.NewBuffer(src))
-	if err := dec.Decode(&dst); err != nil {
-		return dst, err
+// migrate one decoded session of the legacy hash, returns 1 if it is moved
+func (rs redisstore) migrate(hash, key string, val []byte, data Sessiondata) (int, error) {
+	moved := 0
+	if exp, ok := data[expiresTS].(time.Time); ok {
+		if timeout := int(exp.Sub(time.Now()) / time.Second); timeout > 0 {
+			if _, err := rs.client.Do(rs.prefix+key, "SET", rs.prefix+key, val, "EX", timeout); err != nil {
+				return 0, err
+			}
+			moved = 1
+		}
 	}
-	return dst, nil
+
+	_, err := rs.client.Do(hash, "HDEL", hash, key)
+	return moved, err
 }
@@ -0,0 +1,296 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *---------------------------------sentinel-------------------------------------
+ */
+
+// masterAddr asks the sentinels for the address of the master, the first
+// sentinel answering wins
+func masterAddr(config redisConfig) (string, error) {
+	err := errors.New("redis: no sentinel")
+	for _, sentinel := range config.Sentinels {
+		var c redis.Conn
+		// the timeouts and TLS of the options override the defaults
+		c, err = redis.Dial(config.Network, sentinel, append([]redis.DialOption{
+			redis.DialConnectTimeout(time.Second),
+			redis.DialReadTimeout(time.Second),
+			redis.DialWriteTimeout(time.Second)}, config.dialOptions...)...)
+		if err != nil {
+			continue
+		}
+
+		var addr []string
+		addr, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", config.Mastername))
+		c.Close()
+		if err == redis.ErrNil {
+			err = fmt.Errorf("redis: sentinel %s does not know master %s", sentinel, config.Mastername)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(addr) != 2 {
+			err = fmt.Errorf("redis: invalid reply of sentinel %s: %v", sentinel, addr)
+			continue
+		}
+
+		return net.JoinHostPort(addr[0], addr[1]), nil
+	}
+
+	return "", err
+}
+
+// dialMaster dials the master found by the sentinels, and checks its role,
+// since the sentinels may not have noticed a failover yet
+func dialMaster(config redisConfig) (redis.Conn, error) {
+	addr, err := masterAddr(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialNode(config, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := testMaster(c, time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// testMaster checks that the connection is still to the master, so the
+// pooled connections to a master demoted by failover are dropped
+func testMaster(c redis.Conn, t time.Time) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("redis: invalid reply of ROLE")
+	}
+	if r, _ := redis.String(role[0], nil); r != "master" {
+		return fmt.Errorf("redis: role of server is %s, not master", r)
+	}
+	return nil
+}
+
+/*
+ *---------------------------------cluster--------------------------------------
+ */
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+)
+
+// clusterClient routes the commands to the nodes of a redis cluster by the
+// slot of the key, and follows the MOVED and ASK redirections.
+type clusterClient struct {
+	config redisConfig
+
+	lock sync.RWMutex
+	// address of the node serving every slot
+	slots [clusterSlots]string
+	pools map[string]*redis.Pool
+}
+
+func newClusterClient(config redisConfig) (*clusterClient, error) {
+	cc := &clusterClient{
+		config: config,
+		pools:  make(map[string]*redis.Pool),
+	}
+	if config.Lazy {
+		// the slots are fetched by the first command
+		return cc, nil
+	}
+	if err := cc.refresh(); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// refresh fetches the slots of the nodes by CLUSTER SLOTS, from the seed
+// nodes or the known nodes
+func (cc *clusterClient) refresh() error {
+	cc.lock.RLock()
+	addrs := append([]string(nil), cc.config.Addrs...)
+	for addr := range cc.pools {
+		addrs = append(addrs, addr)
+	}
+	cc.lock.RUnlock()
+
+	err := errors.New("redis: no cluster node")
+	for _, addr := range addrs {
+		var slots []interface{}
+		conn := cc.pool(addr).Get()
+		slots, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		return cc.setSlots(slots)
+	}
+
+	return err
+}
+
+// setSlots sets the nodes of the slots by the reply of CLUSTER SLOTS:
+// [[start, end, [ip, port, ...], replicas...], ...]
+func (cc *clusterClient) setSlots(reply []interface{}) error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	for _, r := range reply {
+		v, err := redis.Values(r, nil)
+		if err != nil || len(v) < 3 {
+			return fmt.Errorf("redis: invalid reply of CLUSTER SLOTS: %v", r)
+		}
+		start, err1 := redis.Int(v[0], nil)
+		end, err2 := redis.Int(v[1], nil)
+		master, err3 := redis.Values(v[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 ||
+			start < 0 || end >= clusterSlots || start > end {
+			return fmt.Errorf("redis: invalid reply of CLUSTER SLOTS: %v", r)
+		}
+		ip, err1 := redis.String(master[0], nil)
+		port, err2 := redis.Int(master[1], nil)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("redis: invalid reply of CLUSTER SLOTS: %v", r)
+		}
+
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		for i := start; i <= end; i++ {
+			cc.slots[i] = addr
+		}
+	}
+	return nil
+}
+
+// pool returns the connection pool of node addr
+func (cc *clusterClient) pool(addr string) *redis.Pool {
+	cc.lock.RLock()
+	p, ok := cc.pools[addr]
+	cc.lock.RUnlock()
+	if ok {
+		return p
+	}
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if p, ok := cc.pools[addr]; ok {
+		return p
+	}
+	p = newPool(cc.config, func() (redis.Conn, error) {
+		return dialNode(cc.config, addr)
+	}, testPing)
+	cc.pools[addr] = p
+
+	return p
+}
+
+// Do runs the command on the node serving the slot of key
+func (cc *clusterClient) Do(key string, cmd string, args ...interface{}) (interface{}, error) {
+	slot := keySlot(key)
+
+	cc.lock.RLock()
+	addr := cc.slots[slot]
+	cc.lock.RUnlock()
+	if addr == "" {
+		if err := cc.refresh(); err != nil {
+			return nil, err
+		}
+		cc.lock.RLock()
+		addr = cc.slots[slot]
+		cc.lock.RUnlock()
+		if addr == "" {
+			return nil, fmt.Errorf("redis: slot %d is not served", slot)
+		}
+	}
+
+	asking := false
+	for i := 0; i < clusterMaxRedirects; i++ {
+		conn := cc.pool(addr).Get()
+		if asking {
+			conn.Send("ASKING")
+		}
+		reply, err := conn.Do(cmd, args...)
+		conn.Close()
+
+		rerr, ok := err.(redis.Error)
+		if !ok {
+			return reply, err
+		}
+		// MOVED <slot> <addr>: the slot is served by another node now
+		// ASK <slot> <addr>: the slot is migrating, ask the node this time
+		f := strings.Fields(string(rerr))
+		if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+			return reply, err
+		}
+		addr = f[2]
+		asking = f[0] == "ASK"
+		if !asking {
+			cc.lock.Lock()
+			cc.slots[slot] = addr
+			cc.lock.Unlock()
+		}
+	}
+
+	return nil, fmt.Errorf("redis: too many cluster redirections of key %s", key)
+}
+
+// Close closes the pools of all nodes
+func (cc *clusterClient) Close() error {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	var err error
+	for addr, p := range cc.pools {
+		if e := p.Close(); e != nil {
+			err = e
+		}
+		delete(cc.pools, addr)
+	}
+	return err
+}
+
+// keySlot returns the cluster slot of key, only the hash tag is hashed if
+// key has one, eg. {user1}.name
+func keySlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s != -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,255 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough of the RESP protocol for the redis store: the
+// replies are made by handler, which gets the command and its arguments.
+// SUBSCRIBE and PUBLISH are served by fakeRedis itself.
+type fakeRedis struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	handler func(args []string) interface{}
+	// the subscribed connections of the channels
+	subs map[string][]*bufio.ReadWriter
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) interface{}) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, handler: handler, subs: make(map[string][]*bufio.ReadWriter)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.ln.Addr().String()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	defer fr.unsubscribe(rw)
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "*") {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err = rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, l+2)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+		args[0] = strings.ToUpper(args[0])
+
+		fr.lock.Lock()
+		switch args[0] {
+		case "SUBSCRIBE":
+			for _, ch := range args[1:] {
+				fr.subs[ch] = append(fr.subs[ch], rw)
+				writeReply(rw, []interface{}{[]byte("subscribe"), []byte(ch), 1})
+			}
+		case "PUBLISH":
+			for _, sub := range fr.subs[args[1]] {
+				writeReply(sub, []interface{}{[]byte("message"), []byte(args[1]), []byte(args[2])})
+				sub.Flush()
+			}
+			writeReply(rw, len(fr.subs[args[1]]))
+		default:
+			writeReply(rw, fr.handler(args))
+		}
+		rw.Flush()
+		fr.lock.Unlock()
+	}
+}
+
+// unsubscribe removes the closed connection rw from the channels
+func (fr *fakeRedis) unsubscribe(rw *bufio.ReadWriter) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	for ch, subs := range fr.subs {
+		for i, sub := range subs {
+			if sub == rw {
+				fr.subs[ch] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func writeReply(w io.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		fmt.Fprintf(w, "$-1\r\n")
+	case redis.Error:
+		fmt.Fprintf(w, "-%s\r\n", r)
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, e := range r {
+			writeReply(w, e)
+		}
+	}
+}
+
+// kvHandler serves PING, ROLE, GET, SET and DEL with the map kv, role is the
+// reply of ROLE
+func kvHandler(kv map[string][]byte, role string) func(args []string) interface{} {
+	return func(args []string) interface{} {
+		switch args[0] {
+		case "PING":
+			return "PONG"
+		case "ROLE":
+			return []interface{}{[]byte(role)}
+		case "GET":
+			if v, ok := kv[args[1]]; ok {
+				return v
+			}
+			return nil
+		case "SET":
+			kv[args[1]] = []byte(args[2])
+			return "OK"
+		case "DEL":
+			delete(kv, args[1])
+			return 1
+		}
+		return redis.Error("ERR unknown command " + args[0])
+	}
+}
+
+func Test_RedisKeySlot(t *testing.T) {
+	if s := keySlot("foo"); s != 12182 {
+		t.Error("slot of foo:", s)
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Error("keys with the same hash tag in different slots")
+	}
+	if keySlot("{}foo") != keySlot("{}foo") || keySlot("{}foo") == keySlot("") {
+		t.Error("empty hash tag should hash the whole key")
+	}
+}
+
+func Test_RedisSentinel(t *testing.T) {
+	kv := make(map[string][]byte)
+	master := newFakeRedis(t, kvHandler(kv, "master"))
+	host, port, _ := net.SplitHostPort(master.addr())
+
+	sentinel := newFakeRedis(t, func(args []string) interface{} {
+		if args[0] == "SENTINEL" && len(args) == 3 && args[2] == "mymaster" {
+			return []interface{}{[]byte(host), []byte(port)}
+		}
+		return nil
+	})
+
+	s, err := Open("redis", `{"sentinels": ["127.0.0.1:1", "`+sentinel.addr()+`"], "mastername": "mymaster"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(redisstore).Close()
+
+	ctx := context.Background()
+	data := Sessiondata{"hello": "world", expiresTS: time.Now().Add(time.Minute)}
+	if err := s.Set(ctx, "abc", data, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv["session:abc"]; !ok {
+		t.Fatal("session not set on master", kv)
+	}
+	sd, err := s.Get(ctx, "abc")
+	if err != nil || sd["hello"] != "world" {
+		t.Error("session get failed", sd, err)
+	}
+
+	if _, err := dialMaster(redisConfig{Network: "tcp", Sentinels: []string{sentinel.addr()}, Mastername: "other"}); err == nil {
+		t.Error("unknown master dialed")
+	}
+}
+
+func Test_RedisCluster(t *testing.T) {
+	kv1 := make(map[string][]byte)
+	kv2 := make(map[string][]byte)
+	var node1, node2 *fakeRedis
+
+	slots := func(addr string, start, end int) []interface{} {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		return []interface{}{start, end, []interface{}{[]byte(host), p}}
+	}
+	// node1 claims all slots, but the slot of the session has moved to node2
+	slot := keySlot("session:abc")
+	h1 := kvHandler(kv1, "master")
+	node1 = newFakeRedis(t, func(args []string) interface{} {
+		switch args[0] {
+		case "CLUSTER":
+			return []interface{}{slots(node1.addr(), 0, clusterSlots-1)}
+		case "GET", "SET", "DEL":
+			if keySlot(args[1]) == slot {
+				return redis.Error(fmt.Sprintf("MOVED %d %s", slot, node2.addr()))
+			}
+		}
+		return h1(args)
+	})
+	node2 = newFakeRedis(t, kvHandler(kv2, "master"))
+
+	s, err := Open("redis", `{"cluster": true, "addrs": ["`+node1.addr()+`"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(redisstore).Close()
+
+	ctx := context.Background()
+	data := Sessiondata{"hello": "world", expiresTS: time.Now().Add(time.Minute)}
+	if err := s.Set(ctx, "abc", data, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv2["session:abc"]; !ok {
+		t.Fatal("MOVED not followed", kv1, kv2)
+	}
+	if addr := s.(redisstore).client.(*clusterClient).slots[slot]; addr != node2.addr() {
+		t.Error("slot not updated by MOVED:", addr)
+	}
+	sd, err := s.Get(ctx, "abc")
+	if err != nil || sd["hello"] != "world" {
+		t.Error("session get failed", sd, err)
+	}
+	if err := s.Delete(ctx, "abc"); err != nil || len(kv2) != 0 {
+		t.Error("session delete failed", kv2, err)
+	}
+}
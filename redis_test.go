@@ -1,9 +1,12 @@
 package session
 
 import (
+	"context"
+	"github.com/garyburd/redigo/redis"
 	"github.com/go-martini/martini"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -162,7 +165,7 @@ func Test_RedisSessionClear(t *testing.T) {
 	})
 
 	m.Get("/show", func(session Session) string {
-		if session.Init() == true {
+		if ok, _ := session.Init(); ok {
 			//t.Error("session clear failed!")
 			print("session exist\n")
 		}
@@ -249,3 +252,142 @@ func Test_RedisFlashes(t *testing.T) {
 	req3.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
 	m.ServeHTTP(res3, req3)
 }
+
+func Test_RedisMigrateHash(t *testing.T) {
+	kv := make(map[string][]byte)
+	hashes := make(map[string]map[string][]byte)
+	h := kvHandler(kv, "master")
+	fr := newFakeRedis(t, func(args []string) interface{} {
+		switch args[0] {
+		case "HSET":
+			if hashes[args[1]] == nil {
+				hashes[args[1]] = make(map[string][]byte)
+			}
+			hashes[args[1]][args[2]] = []byte(args[3])
+			return 1
+		case "HSCAN":
+			// everything in one page
+			var fields []interface{}
+			for k, v := range hashes[args[1]] {
+				fields = append(fields, []byte(k), v)
+			}
+			return []interface{}{[]byte("0"), fields}
+		case "HDEL":
+			delete(hashes[args[1]], args[2])
+			return 1
+		case "HLEN":
+			return len(hashes[args[1]])
+		}
+		return h(args)
+	})
+
+	st, err := Open("redis", `{"addr": "`+fr.addr()+`", "prefix": "migrated:"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := st.(redisstore)
+	defer rs.Close()
+
+	const hash = "legacy-sessions"
+	alive := Sessiondata{expiresTS: time.Now().Add(time.Minute), "hello": "world"}
+	expired := Sessiondata{expiresTS: time.Now().Add(-time.Minute)}
+	for key, data := range map[string]Sessiondata{"alive": alive, "expired": expired} {
+		// the old versions wrote gob without the envelope header
+		buf, _ := gobCodec{}.Marshal(data)
+		if _, err := rs.client.Do(hash, "HSET", hash, key, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// eg. a custom type not registered by this program
+	if _, err := rs.client.Do(hash, "HSET", hash, "unknown", []byte("\x05garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, left, err := MigrateRedisHash(context.Background(), st, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || left != 1 {
+		t.Error("expect 1 session moved and 1 left, got", moved, left)
+	}
+
+	data, err := st.Get(context.Background(), "alive")
+	if err != nil || data["hello"] != "world" {
+		t.Error("session not moved", data, err)
+	}
+	if data, _ := st.Get(context.Background(), "expired"); data != nil {
+		t.Error("expired session moved")
+	}
+	if l, _ := redis.Int(rs.client.Do(hash, "HLEN", hash)); l != 1 {
+		t.Error("expect the undecodable session left in legacy hash, got", l)
+	}
+	fr.lock.Lock()
+	_, ok := hashes[hash]["unknown"]
+	fr.lock.Unlock()
+	if !ok {
+		t.Error("undecodable session removed")
+	}
+}
+
+func Test_RedisOptions(t *testing.T) {
+	var cmds []string
+	kv := make(map[string][]byte)
+	h := kvHandler(kv, "master")
+	fr := newFakeRedis(t, func(args []string) interface{} {
+		switch args[0] {
+		case "AUTH", "SELECT":
+			cmds = append(cmds, strings.Join(args, " "))
+			return "OK"
+		}
+		return h(args)
+	})
+
+	st, err := Open("redis", `{"addr": "`+fr.addr()+`", "db": 3, "username": "app", "password": "pass",
+		"maxactive": 2, "wait": true, "connecttimeout": 1000, "readtimeout": 1000, "writetimeout": 1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.(redisstore).Close()
+
+	fr.lock.Lock()
+	if len(cmds) != 2 || cmds[0] != "AUTH app pass" || cmds[1] != "SELECT 3" {
+		t.Error("unexpected commands on dial:", cmds)
+	}
+	fr.lock.Unlock()
+	if p := st.(redisstore).client.(poolClient).pool; p.MaxActive != 2 || !p.Wait {
+		t.Error("pool settings not set", p.MaxActive, p.Wait)
+	}
+
+	if _, err := Open("redis", `{"tls": true, "tlscafile": "/nonexistent/ca.pem"}`); err == nil {
+		t.Error("missing tlscafile accepted")
+	}
+	if _, err := Open("redis", `{"cluster": true, "db": 1}`); err == nil {
+		t.Error("db accepted by cluster")
+	}
+}
+
+func Test_RedisUnreachable(t *testing.T) {
+	// nothing listens on port 1
+	if _, err := Open("redis", `{"addr": "127.0.0.1:1"}`); err == nil {
+		t.Error("unreachable server opened")
+	}
+	if _, err := Open("redis", `{"addr": `); err == nil {
+		t.Error("invalid options accepted")
+	}
+
+	st, err := Open("redis", `{"addr": "127.0.0.1:1", "lazy": true}`)
+	if err != nil {
+		t.Fatal("lazy open failed:", err)
+	}
+	defer st.(redisstore).Close()
+	if _, err := st.Get(context.Background(), "abc"); err == nil {
+		t.Error("dial error not returned by Get")
+	}
+	if p := st.(redisstore).client.(poolClient).pool; p.ActiveCount() != 0 {
+		t.Error("connections leaked:", p.ActiveCount())
+	}
+
+	if _, err := Open("redis", `{"cluster": true, "addrs": ["127.0.0.1:1"]}`); err == nil {
+		t.Error("unreachable cluster opened")
+	}
+}
@@ -1,10 +1,8 @@
 package session
 
 import (
-	"encoding/hex"
-	"fmt"
+	"context"
 	"github.com/go-martini/martini"
-	"github.com/streadway/simpleuuid"
 	"log"
 	"net/http"
 	"strings"
@@ -21,15 +19,26 @@ type Session interface {
 	// signed cookie value
 	CookieValue() string
 
-	// Init session by cookie name, fetch data
-	Init() bool
+	// Init session by cookie name, fetch data from store.
+	// It returns false if there is no valid session, and a non-nil error
+	// if the store failed to fetch the session data.
+	Init() (bool, error)
 
 	// Get returns the session value associated to the given key.
 	Get(key interface{}) interface{}
 
 	// Create a new session ID with sessiondata
+	// If no ID can be generated, no session is created, and Save returns
+	// the error.
 	Create(age int, l *log.Logger)
 
+	// Regenerate moves the session data to a new session ID, and sends the
+	// new cookie. It should be called after login, against session
+	// fixation, and before the privileged data (eg. the user ID) is set:
+	// with a regenerate grace period, the old ID keeps a copy of the data
+	// at the time of Regenerate.
+	Regenerate() error
+
 	// Set sets the session value associated to the given key.
 	SetKey(key interface{}, val interface{})
 
@@ -43,15 +52,18 @@ type Session interface {
 	//delStore()
 
 	// Save is to the client, usualy browsers
-	Save(res http.ResponseWriter)
+	// It fails if the cookie value can not be encoded, eg. the session data
+	// of cookie store exceeds the cookie size limit.
+	Save(res http.ResponseWriter) error
 
 	// Refresh session's expire time by add duration t
 	Refresh(t time.Duration)
 	// Refresh session's expire to time t
 	RefreshTO(t time.Time)
 
-	// Clear cookie, by set cookie's expire to now
-	Clear(res http.ResponseWriter)
+	// Clear cookie, by set cookie's expire to now, and delete the
+	// session data from store
+	Clear(res http.ResponseWriter) error
 
 	// AddFlash adds a flash message to the session.
 	AddFlash(value interface{})
@@ -60,82 +72,33 @@ type Session interface {
 	Flashes() []interface{}
 }
 
-var (
-	store       Store
-	sessionname string = "sid"
-	secretKey   []byte
-	maxAge      int           = 365 * 86400
-	maxDurtion  time.Duration = time.Duration(maxAge) * time.Second
-	httpOnly    bool          = true
-	secure      bool
-)
-
 // Sessions is a Middleware that maps a session.Session service into the Martini
 // handler chain.
 // Sessions can use a number of storage solutions with the given store options.
-// store: memory, redis, memcache, etc
+// store: memory, memory-sharded, redis, memcache, tiered, file, sql, bolt, cookie
 // options: usally json string to open store
+//
+// Sessions configures the default manager; use NewManager to run several
+// session configurations in one process.
 func Sessions(name string,
 	storetype string,
 	dsn string,
 	secret string) martini.Handler {
-	var err error
-
-	store, err = Open(storetype, dsn)
-	if err != nil {
+	if err := defaultManager.open(name, storetype, dsn, secret); err != nil {
 		panic(err)
 	}
-	if name != "" {
-		sessionname = name
-	}
-	if secret == "" {
-		panic("sessions: secret should not be empty!\n")
-	}
-	secretKey = []byte(secret)
 
-	return func(res http.ResponseWriter, r *http.Request, c martini.Context,
-		l *log.Logger) {
-		// Map to the Session interface
-		s := &session{}
-		s.cookie, _ = r.Cookie(name)
-		c.MapTo(s, (*Session)(nil))
-
-		rw := res.(martini.ResponseWriter)
-		rw.Before(func(martini.ResponseWriter) {
-			if s.shouldset {
-				check(s.setStore(), l)
-			}
-			if s.shouldsave {
-				s.Save(res)
-			}
-		})
-	}
+	return defaultManager.Sessions()
 }
 
 // session for goji framework
+// CreateSession configures the default manager used by NewSession
 func CreateSession(name, storetype, dsn, secret string) (err error) {
-	store, err = Open(storetype, dsn)
-	if err != nil {
-		return err
-	}
-
-	if name != "" {
-		sessionname = name
-	}
-	if secret == "" {
-		return fmt.Errorf("secret Should NOT be empty.")
-	}
-
-	secretKey = []byte(secret)
-
-	return nil
+	return defaultManager.open(name, storetype, dsn, secret)
 }
 
 func NewSession(r *http.Request) Session {
-	var s session = session{}
-	s.cookie, _ = r.Cookie(sessionname)
-
-	return &s
+	return defaultManager.NewSession(r)
 }
 
 func check(err error, l *log.Logger) {
@@ -148,28 +111,46 @@ func check(err error, l *log.Logger) {
  *-------------------------global session getting/setting-----------------------
  */
 func MaxAge() int {
-	return maxAge
+	return defaultManager.MaxAge()
 }
 
 func SetMaxAge(age int) {
-	maxAge = age
-	maxDurtion = time.Duration(maxAge) * time.Second
+	defaultManager.SetMaxAge(age)
 }
 
 func HttpOnly() bool {
-	return httpOnly
+	return defaultManager.HttpOnly()
 }
 
 func SetHttpOnly(http bool) {
-	httpOnly = http
+	defaultManager.SetHttpOnly(http)
 }
 
 func Secure() bool {
-	return secure
+	return defaultManager.Secure()
 }
 
 func SetSecure(s bool) {
-	secure = s
+	defaultManager.SetSecure(s)
+}
+
+// SetCookieOptions sets the attributes of the session cookie of the default
+// manager
+func SetCookieOptions(o CookieOptions) {
+	defaultManager.SetCookieOptions(o)
+}
+
+func RegenerateGrace() time.Duration {
+	return defaultManager.RegenerateGrace()
+}
+
+func SetRegenerateGrace(d time.Duration) {
+	defaultManager.SetRegenerateGrace(d)
+}
+
+// Close releases the resources of the store of the default manager
+func Close() error {
+	return defaultManager.Close()
 }
 
 /*
@@ -178,9 +159,12 @@ func SetSecure(s bool) {
 type Sessiondata map[interface{}]interface{}
 
 type session struct {
+	m      *Manager
 	key    string
 	cookie *http.Cookie
 	data   Sessiondata
+	// context of the request, passed to every store operation
+	ctx context.Context
 
 	// status of the session
 	// true: initialed, and get data successfully, otherwise false
@@ -191,6 +175,8 @@ type session struct {
 	shouldset bool
 	// send set-cookie to browser to clear cookie
 	clear bool
+	// the error of Create, returned by flush and Save
+	err error
 }
 
 const (
@@ -199,33 +185,80 @@ const (
 )
 
 func (s *session) CookieValue() string {
-	return Sign(s.key) + "-" + s.key
+	v, _ := s.cookieValue()
+	return v
+}
+
+// cookieValue returns the value of the cookie sent to browsers, it is the
+// signed session ID, or the encoded session data for ClientStore
+func (s *session) cookieValue() (string, error) {
+	if cs, ok := s.m.store.(ClientStore); ok {
+		return cs.Encode(s.data)
+	}
+	return s.m.Sign(s.key) + "-" + s.key, nil
 }
 
 // Returns true if a Session pulled from signed cookie else false
-func (s *session) Init() bool {
+// The error is not nil if the store failed to get the session data
+func (s *session) Init() (bool, error) {
 	cookie := s.cookie
 	if cookie == nil {
-		return false
+		return false, nil
+	}
+
+	if cs, ok := s.m.store.(ClientStore); ok {
+		return s.initClient(cs)
 	}
 
 	// Separate the data from the signature.
 	hyphen := strings.Index(cookie.Value, "-")
 	if hyphen == -1 || hyphen >= len(cookie.Value)-1 {
-		return false
+		return false, nil
 	}
 	sig, data := cookie.Value[:hyphen], cookie.Value[hyphen+1:]
 
 	// Verify the signature.
-	if !Verify(data, sig) {
-		return false
+	ok, current := s.m.verify(data, sig)
+	if !ok {
+		return false, nil
+	}
+
+	sd, err := s.m.store.Get(s.ctx, data)
+	if err != nil {
+		return false, err
+	}
+	if sd == nil {
+		// expired or deleted
+		return false, nil
 	}
 
 	s.key = data
-	s.data = store.Get(data)
+	s.data = sd
+	s.status = true
+	// signed with a previous secret key, re-sign it with the current one
+	if !current {
+		s.shouldsave = true
+	}
+
+	return true, nil
+}
+
+// initClient pulls the session data from the cookie of ClientStore
+func (s *session) initClient(cs ClientStore) (bool, error) {
+	sd, err := cs.Decode(s.cookie.Value)
+	if err != nil {
+		// tampered, or encrypted by another key
+		return false, nil
+	}
+	exp, ok := sd[expiresTS].(time.Time)
+	if !ok || time.Now().After(exp) {
+		return false, nil
+	}
+
+	s.data = sd
 	s.status = true
 
-	return true
+	return true, nil
 }
 
 // Get returns the session value associated to the given key.
@@ -237,14 +270,6 @@ func (s *session) Get(key interface{}) interface{} {
 		return nil
 	}
 
-	if store.Memory() {
-		st := store.(memstore)
-		st.lock.RLock()
-		val := s.data[key]
-		st.lock.RUnlock()
-		return val
-	}
-
 	return s.data[key]
 }
 
@@ -253,21 +278,23 @@ func (s *session) Get(key interface{}) interface{} {
 func (s *session) Create(age int, l *log.Logger) {
 	if s.data != nil || s.cookie != nil {
 		if l != nil {
-			l.Println(warnFormat, "Overwrite exist session "+s.key)
+			l.Printf(warnFormat, "Overwrite exist session "+s.key)
 		}
 	}
 
-	uuid, err := simpleuuid.NewTime(time.Now())
+	key, err := s.m.newID(s.ctx)
 	if err != nil {
-		panic(err) // I don't think this can actually happen.
+		// no session without ID, the error is returned by Save
+		s.err = err
+		return
 	}
 
-	s.key = hex.EncodeToString(uuid[0:16])
+	s.key = key
 	s.data = make(Sessiondata)
 	if age > 0 {
 		s.data[expiresTS] = time.Now().Add(time.Duration(age) * time.Second)
 	} else {
-		s.data[expiresTS] = time.Now().Add(maxDurtion)
+		s.data[expiresTS] = time.Now().Add(s.m.maxDurtion)
 	}
 
 	s.shouldset = true
@@ -275,33 +302,95 @@ func (s *session) Create(age int, l *log.Logger) {
 	s.status = true
 }
 
-// Set sets the session value associated to the given key.
-func (s *session) SetKey(key interface{}, val interface{}) {
+// Regenerate moves the session data to a new session ID, the new cookie is
+// sent by Save. The data is set to the new ID at once, then the old ID is
+// deleted from the store, or kept for the regenerate grace period of the
+// manager, so the concurrent requests with the old cookie still find the
+// session. If the new ID can not be set, the session keeps the old ID.
+// A new session is created if there is none.
+func (s *session) Regenerate() error {
 	if s.data == nil || !s.status {
 		s.Create(0, nil)
+		return s.err
 	}
-	if store.Memory() {
-		st := store.(memstore)
-		st.lock.Lock()
-		s.data[key] = val
-		st.lock.Unlock()
-	} else {
-		s.data[key] = val
+
+	key, err := s.m.newID(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	old := s.key
+	s.key = key
+	s.shouldsave = true
+	if _, ok := s.m.store.(ClientStore); ok {
+		// no ID on server, the data is in cookie
+		return nil
+	}
+
+	// the session is not lost if the store fails
+	if err := s.setStore(); err != nil {
+		s.key = old
 		s.shouldset = true
+		return err
+	}
+
+	grace := s.m.regenerateGrace
+	if grace <= 0 {
+		return s.m.store.Delete(s.ctx, old)
+	}
+
+	// the old ID expires after grace, but never later than the session
+	data := copyData(s.data)
+	e := time.Now().Add(grace)
+	if exp, ok := data[expiresTS].(time.Time); ok && exp.Before(e) {
+		e = exp
 	}
+	data[expiresTS] = e
+	age := int((time.Until(e) + time.Second - 1) / time.Second)
+	return s.m.store.Set(s.ctx, old, data, age)
+}
+
+// Set sets the session value associated to the given key.
+func (s *session) SetKey(key interface{}, val interface{}) {
+	if s.data == nil || !s.status {
+		s.Create(0, nil)
+		if s.err != nil {
+			return
+		}
+	}
+	s.data[key] = val
+	s.shouldset = true
 }
 
 // set session data back to store
 func (s *session) setStore() error {
 	s.shouldset = false
-	if store.Memory() {
-		return store.Set(s.key, s.data, 0)
+	if _, ok := s.m.store.(ClientStore); ok {
+		// the data is stored in cookie
+		s.shouldsave = true
+		return nil
 	}
-
 	now := time.Now()
 	delta := s.data[expiresTS].(time.Time).Sub(now)
 	age := int(delta / time.Second)
-	return store.Set(s.key, s.data, age)
+	return s.m.store.Set(s.ctx, s.key, s.data, age)
+}
+
+// flush set the dirty session data back to store, and send set-cookie
+// to browser if needed. It must be called before the response is written.
+func (s *session) flush(res http.ResponseWriter) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.shouldset {
+		if err := s.setStore(); err != nil {
+			return err
+		}
+	}
+	if s.shouldsave {
+		return s.Save(res)
+	}
+	return nil
 }
 
 // Delete the key/value of session data
@@ -309,78 +398,58 @@ func (s *session) DelKey(key interface{}) {
 	if s.data == nil {
 		return
 	}
-	if store.Memory() {
-		st := store.(memstore)
-
-		st.lock.Lock()
-		delete(s.data, key)
-		st.lock.Unlock()
-	} else {
-		delete(s.data, key)
-		s.shouldset = true
-	}
+	delete(s.data, key)
+	s.shouldset = true
 }
 
 // Delete the session data from store
-func (s *session) delStore() {
+func (s *session) delStore() error {
 	if s.data != nil {
 		s.data = nil
-		store.Delete(s.key)
 		s.shouldset = false
+		return s.m.store.Delete(s.ctx, s.key)
 	}
+	return nil
 }
 
 // Save is to the client, usualy browsers
-func (s *session) Save(res http.ResponseWriter) {
-	s.shouldsave = false
-	cookie := &http.Cookie{
-		Name:     sessionname,
-		Value:    Sign(s.key) + "-" + s.key,
-		Path:     "/",
-		HttpOnly: httpOnly,
-		Secure:   secure,
-		Expires:  s.data[expiresTS].(time.Time).UTC(),
+func (s *session) Save(res http.ResponseWriter) error {
+	if s.err != nil {
+		return s.err
 	}
-	http.SetCookie(res, cookie)
-	return
+	value, err := s.cookieValue()
+	if err != nil {
+		return err
+	}
+
+	s.shouldsave = false
+	s.m.setCookie(res, s.m.newCookie(value, s.data[expiresTS].(time.Time)))
+	return nil
 }
 
-// clear this cookie, by set Expires to now
-func (s *session) Clear(res http.ResponseWriter) {
-	s.delStore()
+// clear this cookie, by set Max-Age to 0 and Expires to the past, with the
+// same Domain and Path as the saved one
+// The cookie is cleared even if the store failed to delete the session data,
+// in that case the error of the store is returned.
+func (s *session) Clear(res http.ResponseWriter) error {
+	err := s.delStore()
 	s.shouldsave = false
 
-	cookie := &http.Cookie{
-		Name:     sessionname,
-		Value:    Sign(s.key) + "-" + s.key,
-		Path:     "/",
-		HttpOnly: httpOnly,
-		Secure:   secure,
-		Expires:  time.Now().UTC(),
+	var value string
+	if _, ok := s.m.store.(ClientStore); !ok {
+		value = s.m.Sign(s.key) + "-" + s.key
 	}
-	http.SetCookie(res, cookie)
-	return
+	s.m.setCookie(res, s.m.clearCookie(value))
+	return err
 }
 
 // Refresh session's expire time by add duration t
 // param t is duration
 func (s *session) Refresh(t time.Duration) {
 	v := s.data[expiresTS].(time.Time).Add(t)
-	n := time.Now()
-
-	if store.Memory() {
-		st := store.(memstore)
-		st.lock.Lock()
-		s.data[expiresTS] = v
-		tmr := s.data["_tmr"].(*time.Timer)
-		if v.After(n) {
-			tmr.Reset(v.Sub(time.Now()))
-		}
-		st.lock.Unlock()
-	} else {
-		s.data[expiresTS] = v
-		s.shouldset = true
-	}
+
+	s.data[expiresTS] = v
+	s.shouldset = true
 	s.shouldsave = true
 }
 
@@ -399,6 +468,9 @@ func (s *session) AddFlash(value interface{}) {
 	}
 	if s.data == nil {
 		s.Create(0, nil)
+		if s.err != nil {
+			return
+		}
 	}
 	s.data[flashesKey] = append(flashes, value)
 	s.shouldset = true
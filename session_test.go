@@ -0,0 +1,391 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Managers(t *testing.T) {
+	admin, err := NewManager("admin", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := NewManager("", "memory", "", "secret456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	s := admin.NewSession(req)
+	s.SetKey("hello", "world")
+	if err := s.(*session).setStore(); err != nil {
+		t.Fatal(err)
+	}
+	s.Save(res)
+
+	req2, _ := http.NewRequest("GET", "/", nil)
+	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+
+	s2 := admin.NewSession(req2)
+	if ok, err := s2.Init(); !ok || err != nil {
+		t.Fatal("admin session init failed", err)
+	}
+	if s2.Get("hello") != "world" {
+		t.Error("admin session write failed")
+	}
+
+	// same cookie value under the public cookie name
+	c, _ := req2.Cookie("admin")
+	req3, _ := http.NewRequest("GET", "/", nil)
+	req3.AddCookie(&http.Cookie{Name: public.Name(), Value: c.Value})
+
+	s3 := public.NewSession(req3)
+	if ok, _ := s3.Init(); ok {
+		t.Error("public manager accepted a cookie signed by admin manager")
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := FromContext(r.Context())
+		if s == nil {
+			t.Fatal("no session in request context")
+		}
+		s.Init()
+		switch r.URL.Path {
+		case "/set":
+			s.SetKey("hello", "world")
+		case "/show":
+			if s.Get("hello") != "world" {
+				t.Error("Session write failed")
+			}
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/set", nil)
+	h.ServeHTTP(res, req)
+	if res.Header().Get("Set-Cookie") == "" {
+		t.Fatal("Set-Cookie not sent before the response body")
+	}
+
+	res2 := httptest.NewRecorder()
+	req2, _ := http.NewRequest("GET", "/show", nil)
+	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	h.ServeHTTP(res2, req2)
+}
+
+func Test_SecretRotation(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "old-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	s := m.NewSession(req)
+	s.SetKey("hello", "world")
+	s.(*session).flush(res)
+
+	m.SetSecrets("new-secret", "old-secret")
+
+	req2, _ := http.NewRequest("GET", "/", nil)
+	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	res2 := httptest.NewRecorder()
+	s2 := m.NewSession(req2)
+	if ok, _ := s2.Init(); !ok || s2.Get("hello") != "world" {
+		t.Fatal("cookie signed with previous secret rejected")
+	}
+	s2.(*session).flush(res2)
+	if res2.Header().Get("Set-Cookie") == "" {
+		t.Fatal("cookie not re-signed with current secret")
+	}
+
+	m.SetSecrets("new-secret")
+
+	req3, _ := http.NewRequest("GET", "/", nil)
+	req3.Header.Set("Cookie", res2.Header().Get("Set-Cookie"))
+	if ok, _ := m.NewSession(req3).Init(); !ok {
+		t.Error("re-signed cookie rejected")
+	}
+
+	req4, _ := http.NewRequest("GET", "/", nil)
+	req4.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	if ok, _ := m.NewSession(req4).Init(); ok {
+		t.Error("cookie signed with retired secret accepted")
+	}
+}
+
+func Test_InitMissingSession(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for name, drop := range map[string]func(key string){
+		"deleted": func(key string) { m.store.Delete(ctx, key) },
+		"expired": func(key string) {
+			m.store.Set(ctx, key, Sessiondata{expiresTS: time.Now().Add(-time.Second)}, 1)
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		res := httptest.NewRecorder()
+		s := m.NewSession(req)
+		s.SetKey("hello", "world")
+		s.(*session).flush(res)
+		drop(s.(*session).key)
+
+		req2, _ := http.NewRequest("GET", "/", nil)
+		req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+		s2 := m.NewSession(req2)
+		if ok, err := s2.Init(); ok || err != nil {
+			t.Error(name, "session accepted by Init", ok, err)
+		}
+		if s2.Get("hello") != nil {
+			t.Error(name, "session data returned", s2.Get("hello"))
+		}
+	}
+}
+
+func Test_SecretsBeforeOpen(t *testing.T) {
+	old, err := NewManager("sid", "memory", "", "old-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SetSecrets before Sessions/CreateSession
+	m := newManager()
+	m.SetSecrets("new-secret", "old-secret")
+	if err := m.open("sid", "memory", "", "new-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Verify("abc", old.Sign("abc")) {
+		t.Error("previous secret dropped by open")
+	}
+	if m.Sign("abc") == old.Sign("abc") {
+		t.Error("not signed with the current secret")
+	}
+}
+
+func Test_SignerMigration(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetSigner(HMACSHA1)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	s := m.NewSession(req)
+	s.SetKey("hello", "world")
+	s.(*session).flush(res)
+
+	m.SetSigner(HMACSHA512, HMACSHA1)
+
+	req2, _ := http.NewRequest("GET", "/", nil)
+	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	res2 := httptest.NewRecorder()
+	s2 := m.NewSession(req2)
+	if ok, _ := s2.Init(); !ok || s2.Get("hello") != "world" {
+		t.Fatal("legacy SHA1 cookie rejected")
+	}
+	s2.(*session).flush(res2)
+	c := res2.Result().Cookies()
+	if len(c) != 1 || !strings.HasPrefix(c[0].Value, HMACSHA512.Version()+".") {
+		t.Fatal("cookie not re-signed with SHA512", c)
+	}
+
+	m.SetSigner(HMACSHA512)
+
+	req3, _ := http.NewRequest("GET", "/", nil)
+	req3.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+	if ok, _ := m.NewSession(req3).Init(); ok {
+		t.Error("SHA1 cookie accepted after migration")
+	}
+}
+
+func Test_Regenerate(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	s := m.NewSession(req)
+	s.SetKey("hello", "world")
+	s.(*session).flush(res)
+
+	regenerate := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+		res2 := httptest.NewRecorder()
+		s := m.NewSession(req)
+		if ok, _ := s.Init(); !ok {
+			t.Fatal("session init failed")
+		}
+		if err := s.Regenerate(); err != nil {
+			t.Fatal(err)
+		}
+		s.(*session).flush(res2)
+		return res2
+	}
+	initOK := func(cookie string) bool {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", cookie)
+		s := m.NewSession(req)
+		ok, _ := s.Init()
+		return ok && s.Get("hello") == "world"
+	}
+
+	res2 := regenerate()
+	if c := res2.Header().Get("Set-Cookie"); c == "" || c == res.Header().Get("Set-Cookie") {
+		t.Fatal("new cookie not sent", c)
+	}
+	if !initOK(res2.Header().Get("Set-Cookie")) {
+		t.Error("data not moved to the new ID")
+	}
+	if initOK(res.Header().Get("Set-Cookie")) {
+		t.Error("old ID not deleted")
+	}
+
+	res = res2
+	m.SetRegenerateGrace(500 * time.Millisecond)
+	regenerate()
+	if !initOK(res.Header().Get("Set-Cookie")) {
+		t.Error("old ID not kept for the grace period")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if initOK(res.Header().Get("Set-Cookie")) {
+		t.Error("old ID kept after the grace period")
+	}
+}
+
+// failStore fails Set while fail is true
+type failStore struct {
+	Store
+	fail *bool
+}
+
+func (fs failStore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	if *fs.fail {
+		return errors.New("store down")
+	}
+	return fs.Store.Set(ctx, key, data, timeout)
+}
+
+func Test_RegenerateStoreFailed(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := false
+	m.store = failStore{Store: m.store, fail: &fail}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := m.NewSession(req)
+	s.SetKey("hello", "world")
+	s.(*session).flush(httptest.NewRecorder())
+	old := s.(*session).key
+
+	fail = true
+	if err := s.Regenerate(); err == nil {
+		t.Error("store error not returned")
+	}
+	fail = false
+	if s.(*session).key != old {
+		t.Error("session moved to a new ID not stored")
+	}
+	if sd, _ := m.store.Get(context.Background(), old); sd == nil || sd["hello"] != "world" {
+		t.Error("session lost by failed Regenerate")
+	}
+
+	if err := s.Regenerate(); err != nil {
+		t.Fatal(err)
+	}
+	// stored before the response is flushed
+	if sd, _ := m.store.Get(context.Background(), s.(*session).key); sd == nil || sd["hello"] != "world" {
+		t.Error("new ID not stored by Regenerate")
+	}
+}
+
+func Test_CookieOptions(t *testing.T) {
+	m, err := NewManager("sid", "memory", "", "secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetCookieOptions(CookieOptions{
+		Domain:      "example.com",
+		Path:        "/app",
+		SameSite:    http.SameSiteNoneMode,
+		Secure:      true,
+		Partitioned: true,
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+	s := m.NewSession(req)
+	s.Create(3600, nil)
+	s.(*session).flush(res)
+
+	res2 := httptest.NewRecorder()
+	s.Clear(res2)
+
+	saved, cleared := res.Result().Cookies()[0], res2.Result().Cookies()[0]
+	for _, c := range []*http.Cookie{saved, cleared} {
+		if c.Domain != "example.com" || c.Path != "/app" || c.SameSite != http.SameSiteNoneMode ||
+			!c.HttpOnly || !c.Secure {
+			t.Errorf("cookie attributes not set: %s", c)
+		}
+	}
+	for _, r := range []*httptest.ResponseRecorder{res, res2} {
+		if h := r.Header().Get("Set-Cookie"); !strings.HasSuffix(h, "; Partitioned") {
+			t.Errorf("cookie not partitioned: %s", h)
+		}
+	}
+	if saved.MaxAge < 3599 || saved.MaxAge > 3600 || saved.Expires.IsZero() {
+		t.Errorf("saved cookie expire: %s", saved)
+	}
+	if cleared.MaxAge >= 0 || !cleared.Expires.Before(time.Now()) {
+		t.Errorf("cleared cookie not expired: %s", cleared)
+	}
+
+	// browser session cookie
+	m.SetCookieOptions(CookieOptions{MaxAge: -1})
+	res3 := httptest.NewRecorder()
+	s = m.NewSession(req)
+	s.Create(3600, nil)
+	s.Save(res3)
+	c := res3.Result().Cookies()[0]
+	if c.MaxAge != 0 || !c.Expires.IsZero() || c.Path != "/" {
+		t.Errorf("browser session cookie: %s", c)
+	}
+
+	// HttpOnly is kept by the options setting other attributes only
+	m.SetCookieOptions(CookieOptions{SameSite: http.SameSiteLaxMode})
+	if !m.HttpOnly() {
+		t.Error("HttpOnly turned off by partial cookie options")
+	}
+	res4 := httptest.NewRecorder()
+	s.Save(res4)
+	if c := res4.Result().Cookies()[0]; !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("partial cookie options: %s", c)
+	}
+	m.SetHttpOnly(false)
+	if m.HttpOnly() || m.CookieOptions().NoHttpOnly != true {
+		t.Error("SetHttpOnly(false) not applied")
+	}
+}
@@ -5,24 +5,145 @@ package session
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"strings"
 )
 
-// Sign a given string with the app-configured secret key.
+// Sign a given string with the secret key of the default manager.
 // If no secret key is set, returns the empty string.
-// Return the signature in base64 (URLEncoding).
+// Return the signature in hex.
 func Sign(message string) string {
-	if len(secretKey) == 0 {
-		return ""
-	}
-	mac := hmac.New(sha1.New, secretKey)
-	io.WriteString(mac, message)
-	return hex.EncodeToString(mac.Sum(nil))
+	return defaultManager.Sign(message)
 }
 
 // Verify returns true if the given signature is correct for the given message.
 // e.g. it matches what we generate with Sign()
 func Verify(message, sig string) bool {
-	return hmac.Equal([]byte(sig), []byte(Sign(message)))
+	return defaultManager.Verify(message, sig)
+}
+
+// Signer signs messages with a secret key
+type Signer interface {
+	// Version is prefixed to the signatures of the signer, so Init knows
+	// which algorithm produced a cookie. It must not contain '.' or '-'.
+	// The legacy HMAC-SHA1 signer has an empty version.
+	Version() string
+
+	// Sign returns the signature of message, it must not contain '-'
+	Sign(key []byte, message string) string
+}
+
+type hmacSigner struct {
+	version string
+	hash    func() hash.Hash
+}
+
+func (hs hmacSigner) Version() string {
+	return hs.version
+}
+
+func (hs hmacSigner) Sign(key []byte, message string) string {
+	mac := hmac.New(hs.hash, key)
+	io.WriteString(mac, message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	// HMACSHA1 is the signer of the cookies of the old versions
+	HMACSHA1 Signer = hmacSigner{"", sha1.New}
+	// HMACSHA256 is the default signer
+	HMACSHA256 Signer = hmacSigner{"2", sha256.New}
+	HMACSHA512 Signer = hmacSigner{"5", sha512.New}
+)
+
+// Sign a given string with the current secret key of the manager.
+// If no secret key is set, returns the empty string.
+// The signature is prefixed by the version of the signer and a '.',
+// except for the legacy HMAC-SHA1 signer.
+func (m *Manager) Sign(message string) string {
+	if len(m.secretKeys) == 0 {
+		return ""
+	}
+	return sign(m.signer, m.secretKeys[0], message)
+}
+
+// Verify returns true if the given signature is correct for the given message
+// with any secret key of the manager, the current one or a previous one,
+// and any signer accepted by the manager.
+func (m *Manager) Verify(message, sig string) bool {
+	ok, _ := m.verify(message, sig)
+	return ok
+}
+
+// verify reports whether sig is correct for message, and whether it was
+// signed with the current signer and the current secret key
+func (m *Manager) verify(message, sig string) (ok bool, current bool) {
+	var version string
+	if dot := strings.Index(sig, "."); dot != -1 {
+		version, sig = sig[:dot], sig[dot+1:]
+	}
+
+	for _, signer := range m.verifiers {
+		if signer.Version() != version {
+			continue
+		}
+		for i, key := range m.secretKeys {
+			if hmac.Equal([]byte(sig), []byte(signer.Sign(key, message))) {
+				return true, i == 0 && version == m.signer.Version()
+			}
+		}
+	}
+	return false, false
+}
+
+// SetSigner sets the signer of the manager, cookies are signed by s,
+// and cookies signed by s or any of accept are accepted.
+// Cookies signed by an accepted signer are re-signed by s on the next
+// response, so the algorithm can be migrated without logging out users.
+// The default signer is HMACSHA256, and HMACSHA1 is accepted.
+func (m *Manager) SetSigner(s Signer, accept ...Signer) {
+	m.signer = s
+	m.verifiers = append([]Signer{s}, accept...)
+}
+
+// SetSigner sets the signer of the default manager
+func SetSigner(s Signer, accept ...Signer) {
+	defaultManager.SetSigner(s, accept...)
+}
+
+// SetSecrets sets the secret keys of the manager. Cookies are signed with
+// current, and the signature of cookies signed with previous are still
+// accepted, such cookies are re-signed with current on the next response.
+// So the secret can be rotated without logging out every user.
+func (m *Manager) SetSecrets(current string, previous ...string) error {
+	if current == "" {
+		return fmt.Errorf("secret Should NOT be empty.")
+	}
+
+	keys := [][]byte{[]byte(current)}
+	for _, p := range previous {
+		if p != "" {
+			keys = append(keys, []byte(p))
+		}
+	}
+	m.secretKeys = keys
+
+	return nil
+}
+
+// SetSecrets sets the secret keys of the default manager
+func SetSecrets(current string, previous ...string) error {
+	return defaultManager.SetSecrets(current, previous...)
+}
+
+func sign(signer Signer, key []byte, message string) string {
+	if v := signer.Version(); v != "" {
+		return v + "." + signer.Sign(key, message)
+	}
+	return signer.Sign(key, message)
 }
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is a session in the snapshot file of memory store,
+// Data is the session data serialized by the default codec
+type snapshotEntry struct {
+	Key  string
+	Data []byte
+}
+
+// save writes the live sessions to file path. It writes a temporary file
+// in the same directory and renames it, so the snapshot is never partial.
+// The sessions failed to serialize, eg. of custom types not registered by
+// gob.Register, are logged and left out.
+func (ms *memstore) save(path string) error {
+	var entries []snapshotEntry
+
+	n := time.Now()
+	for _, sh := range ms.shards {
+		sh.lock.RLock()
+		for key, item := range sh.store {
+			if !item.expires.After(n) {
+				continue
+			}
+			buf, err := serialize(defaultCodec, item.data)
+			if err != nil {
+				log.Printf(errorFormat, fmt.Errorf("memory store: snapshot session %s: %s", key, err.Error()))
+				continue
+			}
+			entries = append(entries, snapshotEntry{Key: key, Data: buf})
+		}
+		sh.lock.RUnlock()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// load reads the sessions not expired from the snapshot file path,
+// a missing file is not an error.
+func (ms *memstore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return fmt.Errorf("memory store: load snapshot %s: %s", path, err.Error())
+	}
+
+	ctx := context.Background()
+	for _, e := range entries {
+		data, err := deserialize(e.Data)
+		if err != nil {
+			return fmt.Errorf("memory store: load snapshot %s: %s", path, err.Error())
+		}
+		// Set drops the expired sessions
+		if _, ok := data[expiresTS].(time.Time); ok {
+			ms.Set(ctx, e.Key, data, 0)
+		}
+	}
+
+	return nil
+}
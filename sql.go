@@ -0,0 +1,235 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlstore keeps the sessions in a table of a database/sql database:
+//
+//	sessions(id, data, expires_at)
+//
+// data is the serialized session data, expires_at is the expire time in
+// unix seconds. The table is created if it does not exist, and the expired
+// sessions are deleted periodically.
+// The driver must be registered by the app, eg. by importing
+// github.com/glebarez/go-sqlite (SQLite without cgo) or github.com/lib/pq.
+type sqlstore struct {
+	db    *sql.DB
+	table string
+	// placeholder style of the driver, "?" or "$" (postgres)
+	dollar bool
+	codec  Codec
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	defaultTable     = "sessions"
+	defaultSQLGCTime = 60
+)
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func init() {
+	Register("sql", &sqlstore{})
+}
+
+// options sample:
+//
+//	`{  "driver": "sqlite",
+//	    "dsn": "file:sessions.db",
+//	    "table": "sessions",
+//	    "gcinterval": 60,
+//	    "codec": "gob"
+//	 }`
+//
+// gcinterval is the interval of deleting the expired sessions in seconds,
+// default 60. codec is gob, json or msgpack, default gob.
+func (ss *sqlstore) Open(options string) (Store, error) {
+	var config struct {
+		Driver     string
+		Dsn        string
+		Table      string
+		Gcinterval int
+		Codec      string
+	}
+
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, fmt.Errorf("sql store: invalid options: %s", err.Error())
+	}
+	if config.Driver == "" {
+		return nil, fmt.Errorf("sql store: driver should not be empty")
+	}
+	if config.Table == "" {
+		config.Table = defaultTable
+	}
+	if !tableName.MatchString(config.Table) {
+		return nil, fmt.Errorf("sql store: invalid table name %q", config.Table)
+	}
+	if config.Gcinterval <= 0 {
+		config.Gcinterval = defaultSQLGCTime
+	}
+	codec, err := openCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(config.Driver, config.Dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &sqlstore{
+		db:     db,
+		table:  config.Table,
+		dollar: strings.HasPrefix(config.Driver, "postgres") || config.Driver == "pgx",
+		codec:  codec,
+		done:   make(chan struct{}),
+	}
+	if err := st.createTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go st.gc(time.Duration(config.Gcinterval) * time.Second)
+
+	return st, nil
+}
+
+// query replaces the table name and the placeholders of q
+func (ss *sqlstore) query(q string) string {
+	q = strings.Replace(q, "{table}", ss.table, -1)
+	if !ss.dollar {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (ss *sqlstore) createTable() error {
+	blob := "BLOB"
+	if ss.dollar {
+		blob = "BYTEA"
+	}
+
+	_, err := ss.db.Exec(ss.query(`CREATE TABLE IF NOT EXISTS {table} (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		data ` + blob + ` NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`))
+	if err != nil {
+		return fmt.Errorf("sql store: create table %s: %s", ss.table, err.Error())
+	}
+	return nil
+}
+
+// for session interface Get
+func (ss *sqlstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	var buf []byte
+	err := ss.db.QueryRowContext(ctx,
+		ss.query(`SELECT data FROM {table} WHERE id = ? AND expires_at > ?`),
+		key, time.Now().Unix()).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := deserialize(buf)
+	if err != nil {
+		return nil, fmt.Errorf("sql store: deserialize: %s", err.Error())
+	}
+	return data, nil
+}
+
+// for session interface SetStore
+func (ss *sqlstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	e := data[expiresTS].(time.Time)
+	if !e.After(time.Now()) {
+		return ss.Delete(ctx, key)
+	}
+
+	buf, err := serialize(ss.codec, data)
+	if err != nil {
+		return err
+	}
+
+	// update, or insert if not exists; if another request inserted it
+	// concurrently, update it again
+	for i := 0; ; i++ {
+		res, err := ss.db.ExecContext(ctx,
+			ss.query(`UPDATE {table} SET data = ?, expires_at = ? WHERE id = ?`),
+			buf, e.Unix(), key)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+
+		_, err = ss.db.ExecContext(ctx,
+			ss.query(`INSERT INTO {table} (id, data, expires_at) VALUES (?, ?, ?)`),
+			key, buf, e.Unix())
+		if err == nil || i > 0 {
+			return err
+		}
+	}
+}
+
+// for session interface DelStore
+func (ss *sqlstore) Delete(ctx context.Context, key string) error {
+	_, err := ss.db.ExecContext(ctx, ss.query(`DELETE FROM {table} WHERE id = ?`), key)
+	return err
+}
+
+// gc deletes the expired sessions every interval, until Close
+func (ss *sqlstore) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ss.done:
+			return
+		case n := <-ticker.C:
+			if err := ss.sweep(n); err != nil {
+				log.Printf(errorFormat, err)
+			}
+		}
+	}
+}
+
+// sweep deletes the sessions expired before n
+func (ss *sqlstore) sweep(n time.Time) error {
+	_, err := ss.db.Exec(ss.query(`DELETE FROM {table} WHERE expires_at <= ?`), n.Unix())
+	return err
+}
+
+// Close stops the sweeper, and closes the database
+func (ss *sqlstore) Close() error {
+	var err error
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		err = ss.db.Close()
+	})
+	return err
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func Test_SQLStore(t *testing.T) {
+	st, err := Open("sql", `{"driver": "sqlite", "dsn": "file::memory:?cache=shared", "table": "web_sessions"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := st.(*sqlstore)
+	defer ss.Close()
+
+	ctx := context.Background()
+	n := time.Now()
+	if err := st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(time.Hour), "hello": "world"}, 3600); err != nil {
+		t.Fatal(err)
+	}
+	// update
+	if err := st.Set(ctx, "alive", Sessiondata{expiresTS: n.Add(2 * time.Hour), "hello": "again"}, 7200); err != nil {
+		t.Fatal(err)
+	}
+	st.Set(ctx, "expiring", Sessiondata{expiresTS: n.Add(time.Minute)}, 60)
+
+	if d, err := st.Get(ctx, "alive"); err != nil || d["hello"] != "again" {
+		t.Error("session write failed", d, err)
+	}
+
+	if err := ss.sweep(n.Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	ss.db.QueryRow("SELECT COUNT(*) FROM web_sessions").Scan(&count)
+	if count != 1 {
+		t.Error("expired session not swept, sessions left:", count)
+	}
+
+	st.Delete(ctx, "alive")
+	if d, _ := st.Get(ctx, "alive"); d != nil {
+		t.Error("session delete failed")
+	}
+
+	if _, err := Open("sql", `{"driver": "sqlite", "table": "x; DROP TABLE y"}`); err == nil {
+		t.Error("invalid table name accepted")
+	}
+}
@@ -1,22 +1,38 @@
 package session
 
 import (
+	"context"
 	"fmt"
 )
 
 var _ = fmt.Printf
 
+// Store is the storage backend of sessions.
+// Every operation takes the context of the request it serves, and reports
+// the failures of the backend to the caller instead of hiding them.
 type Store interface {
 	Open(options string) (Store, error)
-	Get(key string) Sessiondata
-	Set(key string, data Sessiondata, timeout int) error
-	Delete(string)
-
-	// For memory store, return true, otherwise false
-	// This is used by session to distinguaish memory store and others
-	// For memory store, we set/delete key direct from memory, so
-	// it is necessary to lock the memory mutex.
-	Memory() bool
+
+	// Get returns the session data of key.
+	// If the session does not exist or has expired, Get returns nil data
+	// and a nil error; a non-nil error means the store failed.
+	Get(ctx context.Context, key string) (Sessiondata, error)
+	// Set stores the session data of key, timeout is in seconds
+	Set(ctx context.Context, key string, data Sessiondata, timeout int) error
+	// Delete removes the session data of key from store
+	Delete(ctx context.Context, key string) error
+}
+
+// ClientStore is implemented by stores which keep the whole session data
+// in the cookie instead of on the server, eg. the "cookie" store.
+// Get, Set and Delete of such stores do nothing.
+type ClientStore interface {
+	Store
+
+	// Encode returns the cookie value carrying the session data
+	Encode(data Sessiondata) (string, error)
+	// Decode returns the session data carried by the cookie value
+	Decode(value string) (Sessiondata, error)
 }
 
 var stores = make(map[string]Store)
@@ -0,0 +1,395 @@
+package session
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tieredstore serves hot sessions from a bounded in-process cache in front
+// of any registered store. The cached sessions live for a short ttl, and
+// are invalidated by Set and Delete. If several instances share the
+// backend, the invalidations are broadcast by redis pub/sub, so no instance
+// serves a session changed by another one for longer than it takes to
+// deliver a message.
+type tieredstore struct {
+	backend Store
+	cache   *tieredcache
+
+	// pub/sub invalidation, pool is nil if it is disabled
+	pool    *redis.Pool
+	channel string
+	// prefix of the messages of this instance, which are ignored
+	id string
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type tieredcache struct {
+	ttl         time.Duration
+	maxsessions int
+
+	lock  sync.Mutex
+	items map[string]*list.Element
+	// most recently used first
+	lru *list.List
+	// the sessions being read from the backend by Get, a session read
+	// before it is invalidated is not cached
+	loads map[string]*tieredload
+}
+
+type tieredload struct {
+	// Gets reading the session
+	n int
+	// bumped by every invalidation of the session
+	gen uint64
+}
+
+type tieredentry struct {
+	key      string
+	data     Sessiondata
+	cachedAt time.Time
+}
+
+const (
+	defaultTieredTTL      = 5
+	defaultTieredSessions = 10000
+	defaultTieredChannel  = "session:invalidate"
+)
+
+func init() {
+	Register("tiered", &tieredstore{})
+}
+
+// options sample:
+//
+//	`{  "store": "redis",
+//	    "options": {"addr": "127.0.0.1:6379"},
+//	    "ttl": 5,
+//	    "maxsessions": 10000,
+//	    "pubsub": {"addr": "127.0.0.1:6379"},
+//	    "channel": "session:invalidate"
+//	 }`
+//
+// store and options open the backend store, options may also be a string.
+// ttl is the time to live of the cached sessions in seconds.
+// pubsub is the options of the redis server broadcasting invalidations,
+// it is disabled if empty.
+func (ts *tieredstore) Open(options string) (Store, error) {
+	var config struct {
+		Store       string
+		Options     json.RawMessage
+		Ttl         int
+		Maxsessions int
+		Pubsub      json.RawMessage
+		Channel     string
+	}
+
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, fmt.Errorf("tiered store: invalid options: %s", err.Error())
+	}
+	if config.Store == "" || config.Store == "tiered" {
+		return nil, fmt.Errorf("tiered store: invalid backend store %q", config.Store)
+	}
+	if config.Ttl <= 0 {
+		config.Ttl = defaultTieredTTL
+	}
+	if config.Maxsessions <= 0 {
+		config.Maxsessions = defaultTieredSessions
+	}
+	if config.Channel == "" {
+		config.Channel = defaultTieredChannel
+	}
+
+	backend, err := Open(config.Store, rawOptions(config.Options))
+	if err != nil {
+		return nil, err
+	}
+
+	st := &tieredstore{
+		backend: backend,
+		cache: &tieredcache{
+			ttl:         time.Duration(config.Ttl) * time.Second,
+			maxsessions: config.Maxsessions,
+			items:       make(map[string]*list.Element),
+			lru:         list.New(),
+			loads:       make(map[string]*tieredload),
+		},
+		channel: config.Channel,
+		done:    make(chan struct{}),
+	}
+
+	if pubsub := rawOptions(config.Pubsub); pubsub != "" {
+		id := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			// release the backend
+			st.Close()
+			return nil, err
+		}
+		st.id = hex.EncodeToString(id)
+		pc, err := parseRedisOptions(pubsub)
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+		if st.pool, err = createPool(pc); err != nil {
+			st.Close()
+			return nil, err
+		}
+		go st.subscribe()
+	}
+
+	return st, nil
+}
+
+// rawOptions returns the options of a store given as a JSON string, or as
+// a JSON object
+func rawOptions(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// for session interface Get
+func (ts *tieredstore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	if data := ts.cache.get(key); data != nil {
+		// expired but not invalidated
+		if exp, ok := data[expiresTS].(time.Time); ok && exp.After(time.Now()) {
+			return data, nil
+		}
+		ts.cache.remove(key)
+		return nil, nil
+	}
+
+	gen := ts.cache.begin(key)
+	data, err := ts.backend.Get(ctx, key)
+	if err != nil {
+		data = nil
+	}
+	ts.cache.finish(key, gen, data)
+
+	return data, err
+}
+
+// for session interface SetStore
+func (ts *tieredstore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	ts.cache.remove(key)
+	err := ts.backend.Set(ctx, key, data, timeout)
+	// a Get started before the backend is written may have cached the old
+	// data, remove it again
+	ts.cache.remove(key)
+	if err != nil {
+		return err
+	}
+	return ts.publish(key)
+}
+
+// for session interface DelStore
+func (ts *tieredstore) Delete(ctx context.Context, key string) error {
+	ts.cache.remove(key)
+	err := ts.backend.Delete(ctx, key)
+	// a Get started before the backend is written may have cached the old
+	// data, remove it again
+	ts.cache.remove(key)
+	if err != nil {
+		return err
+	}
+	return ts.publish(key)
+}
+
+// publish the invalidation of session key to other instances
+func (ts *tieredstore) publish(key string) error {
+	if ts.pool == nil {
+		return nil
+	}
+
+	conn := ts.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", ts.channel, ts.id+" "+key)
+	return err
+}
+
+// subscribe receives the invalidations of other instances until Close,
+// and reconnects if the connection is lost
+func (ts *tieredstore) subscribe() {
+	for {
+		err := ts.receive()
+		select {
+		case <-ts.done:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf(errorFormat, err)
+		}
+		// the messages may be lost while reconnecting
+		ts.cache.clear()
+
+		select {
+		case <-ts.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (ts *tieredstore) receive() error {
+	// a connection of its own, pooled connections can not be closed while
+	// receiving
+	conn, err := ts.pool.Dial()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err := psc.Subscribe(ts.channel); err != nil {
+		return err
+	}
+
+	// unblock Receive on Close
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ts.done:
+			psc.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			msg := string(v.Data)
+			sp := strings.IndexByte(msg, ' ')
+			if sp == -1 || msg[:sp] == ts.id {
+				continue
+			}
+			ts.cache.remove(msg[sp+1:])
+		case error:
+			return v
+		}
+	}
+}
+
+// Close stops the invalidation subscriber, and closes the backend store
+func (ts *tieredstore) Close() error {
+	var err error
+	ts.closeOnce.Do(func() {
+		close(ts.done)
+		if ts.pool != nil {
+			ts.pool.Close()
+		}
+		if c, ok := ts.backend.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+// get returns a copy of the cached session key, nil if it is not cached
+// or older than ttl
+func (tc *tieredcache) get(key string) Sessiondata {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	elem, ok := tc.items[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*tieredentry)
+	if time.Since(e.cachedAt) > tc.ttl {
+		tc.lru.Remove(elem)
+		delete(tc.items, key)
+		return nil
+	}
+
+	tc.lru.MoveToFront(elem)
+	return copyData(e.data)
+}
+
+// put caches a copy of the session key, and evicts the least recently
+// used sessions if the cache is full. The lock must be held.
+func (tc *tieredcache) put(key string, data Sessiondata) {
+	e := &tieredentry{key: key, data: copyData(data), cachedAt: time.Now()}
+	if elem, ok := tc.items[key]; ok {
+		elem.Value = e
+		tc.lru.MoveToFront(elem)
+		return
+	}
+
+	tc.items[key] = tc.lru.PushFront(e)
+	for tc.lru.Len() > tc.maxsessions {
+		back := tc.lru.Back()
+		tc.lru.Remove(back)
+		delete(tc.items, back.Value.(*tieredentry).key)
+	}
+}
+
+// begin starts reading session key from the backend, it returns the
+// generation of the session passed to finish
+func (tc *tieredcache) begin(key string) uint64 {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	l, ok := tc.loads[key]
+	if !ok {
+		l = &tieredload{}
+		tc.loads[key] = l
+	}
+	l.n++
+	return l.gen
+}
+
+// finish caches the session key read from the backend, unless it is nil or
+// it was invalidated since begin, then the data read may be stale
+func (tc *tieredcache) finish(key string, gen uint64, data Sessiondata) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	l := tc.loads[key]
+	l.n--
+	if l.n == 0 {
+		delete(tc.loads, key)
+	}
+	if data != nil && l.gen == gen {
+		tc.put(key, data)
+	}
+}
+
+func (tc *tieredcache) remove(key string) {
+	tc.lock.Lock()
+	if elem, ok := tc.items[key]; ok {
+		tc.lru.Remove(elem)
+		delete(tc.items, key)
+	}
+	if l, ok := tc.loads[key]; ok {
+		l.gen++
+	}
+	tc.lock.Unlock()
+}
+
+func (tc *tieredcache) clear() {
+	tc.lock.Lock()
+	tc.items = make(map[string]*list.Element)
+	tc.lru.Init()
+	for _, l := range tc.loads {
+		l.gen++
+	}
+	tc.lock.Unlock()
+}
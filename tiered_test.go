@@ -0,0 +1,169 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_TieredStore(t *testing.T) {
+	st, err := Open("tiered", `{"store": "memory", "ttl": 60, "maxsessions": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := st.(*tieredstore)
+	defer ts.Close()
+
+	ctx := context.Background()
+	data := Sessiondata{expiresTS: time.Now().Add(time.Hour), "hello": "world"}
+	st.Set(ctx, "a", data, 3600)
+	st.Get(ctx, "a")
+
+	// changed behind the cache
+	ts.backend.Set(ctx, "a", Sessiondata{expiresTS: time.Now().Add(time.Hour), "hello": "backend"}, 3600)
+	if d, _ := st.Get(ctx, "a"); d["hello"] != "world" {
+		t.Error("session not served from cache")
+	}
+
+	// Set invalidates the cache
+	st.Set(ctx, "a", Sessiondata{expiresTS: time.Now().Add(time.Hour), "hello": "again"}, 3600)
+	if d, _ := st.Get(ctx, "a"); d["hello"] != "again" {
+		t.Error("cache not invalidated by Set")
+	}
+
+	st.Set(ctx, "b", data, 3600)
+	st.Set(ctx, "c", data, 3600)
+	st.Get(ctx, "b")
+	st.Get(ctx, "c")
+	if len(ts.cache.items) != 2 {
+		t.Error("cache not bounded", len(ts.cache.items))
+	}
+
+	st.Delete(ctx, "c")
+	if d, _ := st.Get(ctx, "c"); d != nil {
+		t.Error("cache not invalidated by Delete")
+	}
+}
+
+func Test_TieredPubSub(t *testing.T) {
+	fr := newFakeRedis(t, kvHandler(make(map[string][]byte), "master"))
+	options := fmt.Sprintf(`{"store": "redis", "options": {"addr": %q}, "ttl": 60, "pubsub": {"addr": %q}}`,
+		fr.addr(), fr.addr())
+	st1, err := Open("tiered", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st1.(*tieredstore).Close()
+	st2, err := Open("tiered", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st2.(*tieredstore).Close()
+	// wait for the subscribers
+	time.Sleep(100 * time.Millisecond)
+
+	ctx := context.Background()
+	st1.Set(ctx, "pubsub", Sessiondata{expiresTS: time.Now().Add(time.Minute), "hello": "world"}, 60)
+	if d, _ := st2.Get(ctx, "pubsub"); d["hello"] != "world" {
+		t.Fatal("session write failed")
+	}
+
+	st1.Set(ctx, "pubsub", Sessiondata{expiresTS: time.Now().Add(time.Minute), "hello": "again"}, 60)
+	time.Sleep(100 * time.Millisecond)
+	if d, _ := st2.Get(ctx, "pubsub"); d["hello"] != "again" {
+		t.Error("cache of other instance not invalidated")
+	}
+}
+
+// slowStore blocks Get until release is closed, after reading the data
+type slowStore struct {
+	Store
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (ss slowStore) Get(ctx context.Context, key string) (Sessiondata, error) {
+	data, err := ss.Store.Get(ctx, key)
+	close(ss.read)
+	<-ss.release
+	return data, err
+}
+
+func Test_TieredGetSetRace(t *testing.T) {
+	st, err := Open("tiered", `{"store": "memory", "ttl": 60}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := st.(*tieredstore)
+	defer ts.Close()
+
+	ctx := context.Background()
+	e := time.Now().Add(time.Hour)
+	st.Set(ctx, "a", Sessiondata{expiresTS: e, "v": "old"}, 3600)
+
+	slow := slowStore{Store: ts.backend, read: make(chan struct{}), release: make(chan struct{})}
+	ts.backend = slow
+	done := make(chan struct{})
+	go func() {
+		st.Get(ctx, "a")
+		close(done)
+	}()
+
+	// the Get read the old value, then Set writes the new one
+	<-slow.read
+	ts.backend = slow.Store
+	st.Set(ctx, "a", Sessiondata{expiresTS: e, "v": "new"}, 3600)
+	close(slow.release)
+	<-done
+
+	if d, _ := st.Get(ctx, "a"); d["v"] != "new" {
+		t.Error("stale session cached by a Get racing with Set:", d["v"])
+	}
+}
+
+// blockSetStore blocks Set until release is closed, before writing the data
+type blockSetStore struct {
+	Store
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bs blockSetStore) Set(ctx context.Context, key string, data Sessiondata, timeout int) error {
+	close(bs.writing)
+	<-bs.release
+	return bs.Store.Set(ctx, key, data, timeout)
+}
+
+func Test_TieredSetGetRace(t *testing.T) {
+	st, err := Open("tiered", `{"store": "memory", "ttl": 60}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := st.(*tieredstore)
+	defer ts.Close()
+
+	ctx := context.Background()
+	e := time.Now().Add(time.Hour)
+	st.Set(ctx, "a", Sessiondata{expiresTS: e, "v": "old"}, 3600)
+
+	block := blockSetStore{Store: ts.backend, writing: make(chan struct{}), release: make(chan struct{})}
+	ts.backend = block
+	done := make(chan struct{})
+	go func() {
+		st.Set(ctx, "a", Sessiondata{expiresTS: e, "v": "new"}, 3600)
+		close(done)
+	}()
+
+	// the Get reads the old value before Set writes the new one
+	<-block.writing
+	if d, _ := st.Get(ctx, "a"); d["v"] != "old" {
+		t.Fatal("session written before Set released:", d["v"])
+	}
+	close(block.release)
+	<-done
+
+	if d, _ := st.Get(ctx, "a"); d["v"] != "new" {
+		t.Error("stale session cached by a Get racing with Set:", d["v"])
+	}
+}